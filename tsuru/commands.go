@@ -5,23 +5,375 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/installer"
 	"github.com/tsuru/tsuru/cmd"
 	"launchpad.net/gnuflag"
 )
 
+// installHooks are given to the installers created by install. They're only
+// set by tests, which run the components in a fake Docker server.
+var installHooks installer.Hooks
+
 type install struct {
-	fs *gnuflag.FlagSet
+	fs       *gnuflag.FlagSet
+	iaas     string
+	config   string
+	template string
+	sshKey   string
+	dryRun   bool
+	params   map[string]*paramFlag
+	// flagsErr is the error found adding the flags of the params, returned
+	// by Run.
+	flagsErr error
+}
+
+// paramFlag is a command line flag holding a param of an iaas. The flag is
+// named after the iaas and the param, like --ec2-image.
+type paramFlag struct {
+	provider string
+	param    string
+	value    string
+	set      bool
+	isBool   bool
+}
+
+func (f *paramFlag) String() string {
+	return f.value
+}
+
+func (f *paramFlag) Set(value string) error {
+	f.value = value
+	f.set = true
+	return nil
+}
+
+func (f *paramFlag) IsBoolFlag() bool {
+	return f.isBool
 }
 
 func (c *install) Info() *cmd.Info {
 	return &cmd.Info{
-		Name:    "install",
-		Usage:   "install",
-		Desc:    "",
+		Name:  "install",
+		Usage: "install [--config file] [--iaas name] [--template name] [--admin-ssh-key file] [--dry-run] [--<iaas>-<param> value]...",
+		Desc: `Creates the machines using the given iaas and installs tsuru on them.
+
+The installation is described by a YAML file given in --config. The --iaas
+flag overrides the iaas defined in the file. With --dry-run, the machines,
+containers and configuration files are printed, along with the problems
+that would make the install fail, and nothing is created.
+
+The params of the iaas can also be given as flags prefixed with the name of
+the iaas, like --docker-machine-virtualbox-memory 4096, overriding the
+params in the file. With --template, the iaas and params of the
+given machine template are used, and the params in the file and in the
+flags override the ones in the template. When the params are invalid, the
+ones accepted by the iaas are described.
+
+The public key in --admin-ssh-key, or in ~/.ssh/id_rsa.pub by default, is
+registered for the admin user, so apps can be deployed with git push.
+
+Available iaas: ` + strings.Join(iaas.List(), ", "),
 		MinArgs: 0,
 	}
 }
 
+func (c *install) Flags() *gnuflag.FlagSet {
+	if c.fs == nil {
+		c.fs = gnuflag.NewFlagSet("install", gnuflag.ExitOnError)
+		c.fs.StringVar(&c.iaas, "iaas", "", "The iaas used to create the machines")
+		c.fs.StringVar(&c.iaas, "i", "", "The iaas used to create the machines")
+		c.fs.StringVar(&c.config, "config", "", "YAML file describing the installation")
+		c.fs.StringVar(&c.config, "c", "", "YAML file describing the installation")
+		c.fs.StringVar(&c.template, "template", "", "Machine template used to create the machines")
+		c.fs.StringVar(&c.template, "t", "", "Machine template used to create the machines")
+		c.fs.StringVar(&c.sshKey, "admin-ssh-key", "", "Public SSH key registered for the admin user")
+		c.fs.BoolVar(&c.dryRun, "dry-run", false, "Print what would be done without creating anything")
+		c.flagsErr = c.addParamFlags()
+	}
+	return c.fs
+}
+
+// addParamFlags adds a flag for each param declared by the providers,
+// named <iaas>-<param>. It fails when the name of a flag is already taken.
+func (c *install) addParamFlags() error {
+	c.params = make(map[string]*paramFlag)
+	for _, provider := range iaas.List() {
+		flags, err := iaas.Flags(provider)
+		if err != nil {
+			return err
+		}
+		for _, f := range flags {
+			name := provider + "-" + f.Name
+			if c.fs.Lookup(name) != nil {
+				return fmt.Errorf("flag --%s of iaas %q is already defined", name, provider)
+			}
+			usage := f.Usage
+			if len(f.Values) > 0 {
+				usage += ", one of " + strings.Join(f.Values, ", ")
+			}
+			if f.Value != "" {
+				usage += ", defaults to " + f.Value
+			}
+			if f.Required {
+				usage += " (required)"
+			}
+			p := &paramFlag{provider: provider, param: f.Name, isBool: f.Type == iaas.BoolFlag}
+			c.params[name] = p
+			c.fs.Var(p, name, usage)
+		}
+	}
+	return nil
+}
+
+// setParams copies the param flags given in the command line to the params
+// of the iaas, failing for flags of other iaas.
+func (c *install) setParams(conf *installer.Config) error {
+	var names []string
+	for name, p := range c.params {
+		if p.set {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := c.params[name]
+		if p.provider != conf.Iaas.Name {
+			return fmt.Errorf("flag --%s is not accepted by iaas %q", name, conf.Iaas.Name)
+		}
+		if conf.Iaas.Params == nil {
+			conf.Iaas.Params = make(map[string]string)
+		}
+		conf.Iaas.Params[p.param] = p.value
+	}
+	return nil
+}
+
 func (c *install) Run(context *cmd.Context, client *cmd.Client) error {
+	if c.flagsErr != nil {
+		return c.flagsErr
+	}
+	conf := installer.DefaultConfig()
+	if c.config != "" {
+		var err error
+		conf, err = installer.LoadConfig(c.config)
+		if err != nil {
+			return err
+		}
+	}
+	if c.template != "" {
+		err := installer.ApplyTemplate(conf, c.template)
+		if err != nil {
+			return err
+		}
+		if c.iaas != "" && c.iaas != conf.Iaas.Name {
+			return fmt.Errorf("template %q uses iaas %q, not %q", c.template, conf.Iaas.Name, c.iaas)
+		}
+	} else if c.iaas != "" {
+		conf.Iaas.Name = c.iaas
+	}
+	if c.sshKey != "" {
+		conf.Admin.SSHKey = c.sshKey
+	}
+	err := c.setParams(conf)
+	if err != nil {
+		return err
+	}
+	i := &installer.Installer{
+		Config: conf,
+		Out:    context.Stdout,
+		Hooks:  installHooks,
+	}
+	if c.dryRun {
+		err = i.Plan()
+		describeParams(context, err)
+		return err
+	}
+	installation, err := i.Install()
+	if err != nil {
+		describeParams(context, err)
+		if e, ok := err.(*installer.InstallError); ok && len(e.Undone) > 0 {
+			fmt.Fprintln(context.Stderr, "The following steps were rolled back:")
+			for _, step := range e.Undone {
+				fmt.Fprintf(context.Stderr, "  %s\n", step)
+			}
+		}
+		return err
+	}
+	err = runBaseCommand(context, "target-add", installation.Name, installation.APIURL)
+	if err != nil {
+		fmt.Fprintf(context.Stderr, "Failed to add target %q: %s\n", installation.Name, err)
+	}
+	fmt.Fprintf(context.Stdout, "tsuru API is running at %s\n", installation.APIURL)
+	fmt.Fprintf(context.Stdout, "Admin user: %s\n", installation.Admin.Email)
+	fmt.Fprintf(context.Stdout, "Admin password: %s\n", installation.Admin.Password)
+	return nil
+}
+
+// describeParams writes the description of the params accepted by the iaas
+// when the error is about invalid params.
+func describeParams(context *cmd.Context, err error) {
+	e, ok := err.(*iaas.ParamsError)
+	if !ok {
+		return
+	}
+	desc, err := iaas.Describe(e.Iaas)
+	if err == nil && desc != "" {
+		fmt.Fprint(context.Stderr, desc)
+	}
+}
+
+type templateAdd struct{}
+
+func (c *templateAdd) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "machine-template-add",
+		Usage: "machine-template-add <name> <iaas> <param>=<value>...",
+		Desc: `Saves a machine template, a named set of iaas params that can be given
+to install with --template.`,
+		MinArgs: 2,
+	}
+}
+
+func (c *templateAdd) Run(context *cmd.Context, client *cmd.Client) error {
+	t := installer.Template{Name: context.Args[0], Iaas: context.Args[1]}
+	for _, param := range context.Args[2:] {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid param %q, it must be in the form <param>=<value>", param)
+		}
+		if t.Params == nil {
+			t.Params = make(map[string]string)
+		}
+		t.Params[parts[0]] = parts[1]
+	}
+	err := installer.AddTemplate(t)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Template %q added.\n", t.Name)
+	return nil
+}
+
+type templateList struct{}
+
+func (c *templateList) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "machine-template-list",
+		Usage:   "machine-template-list",
+		Desc:    "Lists the machine templates.",
+		MinArgs: 0,
+	}
+}
+
+func (c *templateList) Run(context *cmd.Context, client *cmd.Client) error {
+	templates, err := installer.ListTemplates()
+	if err != nil {
+		return err
+	}
+	table := cmd.NewTable()
+	table.Headers = cmd.Row{"Name", "IaaS", "Params"}
+	table.LineSeparator = true
+	for _, t := range templates {
+		var params []string
+		for k, v := range t.Params {
+			params = append(params, k+"="+v)
+		}
+		sort.Strings(params)
+		table.AddRow(cmd.Row{t.Name, t.Iaas, strings.Join(params, "\n")})
+	}
+	context.Stdout.Write(table.Bytes())
+	return nil
+}
+
+type templateRemove struct{}
+
+func (c *templateRemove) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:    "machine-template-remove",
+		Usage:   "machine-template-remove <name>",
+		Desc:    "Removes the given machine template.",
+		MinArgs: 1,
+		MaxArgs: 1,
+	}
+}
+
+func (c *templateRemove) Run(context *cmd.Context, client *cmd.Client) error {
+	err := installer.RemoveTemplate(context.Args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(context.Stdout, "Template %q removed.\n", context.Args[0])
 	return nil
 }
+
+type uninstall struct {
+	cmd.ConfirmationCommand
+}
+
+func (c *uninstall) Info() *cmd.Info {
+	return &cmd.Info{
+		Name:  "uninstall",
+		Usage: "uninstall [name] [-y]",
+		Desc: `Removes the tsuru components and deletes every machine created by the
+installation with the given name, along with its local state and target.
+The name defaults to "tsuru".`,
+		MinArgs: 0,
+		MaxArgs: 1,
+	}
+}
+
+func (c *uninstall) Run(context *cmd.Context, client *cmd.Client) error {
+	name := "tsuru"
+	if len(context.Args) > 0 {
+		name = context.Args[0]
+	}
+	state, err := installer.LoadState(name)
+	if err != nil {
+		return err
+	}
+	question := fmt.Sprintf("Are you sure you want to destroy the installation %q and its %d machine(s)?", name, len(state.Machines))
+	if !c.Confirm(context, question) {
+		return nil
+	}
+	err = installer.Uninstall(name, context.Stdout)
+	if err != nil {
+		return err
+	}
+	err = runBaseCommand(context, "target-remove", name)
+	if err != nil {
+		fmt.Fprintf(context.Stderr, "Failed to remove target %q: %s\n", name, err)
+	}
+	fmt.Fprintf(context.Stdout, "Installation %q destroyed.\n", name)
+	return nil
+}
+
+type destroy struct {
+	uninstall
+}
+
+func (c *destroy) Info() *cmd.Info {
+	info := c.uninstall.Info()
+	info.Name = "destroy"
+	info.Usage = "destroy [name] [-y]"
+	info.Desc += "\n\nThis command is an alias to uninstall."
+	return info
+}
+
+// runBaseCommand runs one of the commands provided by tsuru's base manager,
+// like target-add and target-remove.
+func runBaseCommand(context *cmd.Context, name string, args ...string) error {
+	m := cmd.BuildBaseManager("yati", version, "", nil)
+	ctx := &cmd.Context{
+		Args:   args,
+		Stdout: ioutil.Discard,
+		Stderr: context.Stderr,
+		Stdin:  context.Stdin,
+	}
+	return m.Commands[name].Run(ctx, nil)
+}
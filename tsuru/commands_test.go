@@ -6,17 +6,39 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 
+	"github.com/andrewsmedina/yati/tsuru/installer"
 	"github.com/tsuru/tsuru/cmd"
 	"gopkg.in/check.v1"
+	"launchpad.net/gnuflag"
 )
 
 func (s *S) TestInstallInfo(c *check.C) {
-	c.Assert((&install{}).Info(), check.NotNil)
+	info := (&install{}).Info()
+	c.Assert(info, check.NotNil)
+	c.Assert(info.Desc, check.Matches, `(?s).*Available iaas: .*\btest-iaas\b.*`)
 }
 
 func (s *S) TestInstall(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{iaas: "test-iaas"}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	expected := fmt.Sprintf("tsuru API is running at http://%s:8080\n", testProvider.address)
+	c.Assert(stdout.String(), check.Matches, "(?s).*"+expected+"Admin user: admin@example.com\nAdmin password: .+\n")
+}
+
+func (s *S) TestInstallDryRun(c *check.C) {
 	var stdout, stderr bytes.Buffer
 	context := cmd.Context{
 		Stdout: &stdout,
@@ -24,7 +46,361 @@ func (s *S) TestInstall(c *check.C) {
 	}
 	client := cmd.NewClient(&http.Client{}, nil, manager)
 	command := install{}
+	command.Flags().Parse(true, []string{"--iaas", "test-iaas", "--dry-run"})
 	err := command.Run(&context, client)
 	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s)Installation "tsuru" using iaas "test-iaas".*tsuru-api:/etc/tsuru/tsuru.conf:.*`)
+	c.Assert(stdout.String(), check.Not(check.Matches), "(?s).*tsuru API is running.*")
+	_, err = installer.LoadState("tsuru")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestInstallWithConfig(c *check.C) {
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("iaas:\n  name: test-iaas\nadmin:\n  email: root@example.com\n  password: s3cr3t\n")
+	f.Close()
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{config: f.Name()}
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, "(?s).*Admin user: root@example.com\nAdmin password: s3cr3t\n")
+}
+
+func (s *S) TestInstallWithInvalidConfig(c *check.C) {
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("iaas:\n  name: test-iaas\nmachine: 2\n")
+	f.Close()
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{config: f.Name()}
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `(?s).*line 3: unknown key "machine".*`)
 	c.Assert(stdout.String(), check.Equals, "")
 }
+
+func (s *S) TestInstallReportsRollback(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	s.server.PrepareFailure("create-error", "/containers/create")
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{iaas: "test-iaas"}
+	err := command.Run(&context, client)
+	c.Assert(err, check.NotNil)
+	c.Assert(stderr.String(), check.Equals, "The following steps were rolled back:\n  create-machines\n")
+}
+
+func (s *S) TestInstallFlags(c *check.C) {
+	command := install{}
+	flags := command.Flags()
+	err := flags.Parse(true, []string{"--iaas", "fake", "--config", "yati.yml", "--admin-ssh-key", "id.pub", "--dry-run"})
+	c.Assert(err, check.IsNil)
+	c.Assert(command.iaas, check.Equals, "fake")
+	c.Assert(command.config, check.Equals, "yati.yml")
+	c.Assert(command.sshKey, check.Equals, "id.pub")
+	c.Assert(command.dryRun, check.Equals, true)
+}
+
+func (s *S) TestInstallWithSSHKey(c *check.C) {
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	key := "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBCzei1sMh5ohWGPpyp06a7knmkIQcD+SsQiSiM9SzXHDMR/X2h4iWlTh+e8WN5cYAX3JbIxnFXCAb262lLJnWOE= admin@host"
+	f.WriteString(key + "\n")
+	f.Close()
+	var keys []string
+	installHooks.AddSSHKey = func(gandalfURL, user, key string) error {
+		keys = append(keys, user+" "+key)
+		return nil
+	}
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{iaas: "test-iaas", sshKey: f.Name()}
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(keys, check.DeepEquals, []string{"admin@example.com " + key})
+}
+
+func (s *S) TestInstallIaasFlags(c *check.C) {
+	command := install{}
+	flags := command.Flags()
+	memory := flags.Lookup("test-iaas-memory")
+	c.Assert(memory, check.NotNil)
+	c.Assert(memory.Usage, check.Equals, "Memory of the machine, defaults to 1024")
+	c.Assert(flags.Lookup("ec2-region").Usage, check.Equals, "Chosen region, defaults to us-east-1")
+	c.Assert(flags.Lookup("digitalocean-region").Usage, check.Equals, "Region of the droplet, defaults to nyc3")
+	c.Assert(flags.Lookup("region"), check.IsNil)
+	c.Assert(flags.Lookup("config").Usage, check.Equals, "YAML file describing the installation")
+	c.Assert(flags.Lookup("test-iaas-config").Usage, check.Equals, "Config of the machine")
+}
+
+func (s *S) TestInstallIaasFlagsCollision(c *check.C) {
+	command := install{fs: gnuflag.NewFlagSet("install", gnuflag.ContinueOnError)}
+	command.fs.String("test-iaas-memory", "", "Taken")
+	err := command.addParamFlags()
+	c.Assert(err, check.ErrorMatches, `flag --test-iaas-memory of iaas "test-iaas" is already defined`)
+	command.flagsErr = err
+	err = command.Run(&cmd.Context{Stdout: ioutil.Discard, Stderr: ioutil.Discard}, nil)
+	c.Assert(err, check.Equals, command.flagsErr)
+}
+
+func (s *S) TestInstallWithIaasFlags(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{}
+	err := command.Flags().Parse(true, []string{"--iaas", "test-iaas", "--test-iaas-memory", "4096", "--test-iaas-verbose"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.params, check.DeepEquals, map[string]string{"memory": "4096", "verbose": "true"})
+}
+
+func (s *S) TestInstallIaasFlagsOverrideConfig(c *check.C) {
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString("iaas:\n  name: test-iaas\n  params:\n    memory: 2048\n    verbose: 1\n")
+	f.Close()
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{}
+	err = command.Flags().Parse(true, []string{"--config", f.Name(), "--test-iaas-memory", "4096"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.params, check.DeepEquals, map[string]string{"memory": "4096", "verbose": "true"})
+}
+
+func (s *S) TestInstallIaasFlagNotAccepted(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{}
+	err := command.Flags().Parse(true, []string{"--iaas", "test-iaas", "--docker-machine-virtualbox-memory", "4096"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `flag --docker-machine-virtualbox-memory is not accepted by iaas "test-iaas"`)
+	c.Assert(testProvider.params, check.IsNil)
+}
+
+func (s *S) TestInstallInvalidParamsDescribesIaas(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{}
+	err := command.Flags().Parse(true, []string{"--iaas", "test-iaas", "--test-iaas-memory", "lots"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `(?s)invalid params for iaas "test-iaas":.*`)
+	c.Assert(stderr.String(), check.Equals, "Test IaaS params: memory, verbose and config.\n")
+	stderr.Reset()
+	command = install{}
+	err = command.Flags().Parse(true, []string{"--iaas", "test-iaas", "--test-iaas-memory", "lots", "--dry-run"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.NotNil)
+	c.Assert(stderr.String(), check.Equals, "Test IaaS params: memory, verbose and config.\n")
+}
+
+func (s *S) TestInstallWithTemplate(c *check.C) {
+	err := installer.AddTemplate(installer.Template{
+		Name:   "large",
+		Iaas:   "test-iaas",
+		Params: map[string]string{"memory": "8192", "verbose": "true"},
+	})
+	c.Assert(err, check.IsNil)
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{}
+	err = command.Flags().Parse(true, []string{"--template", "large", "--test-iaas-memory", "4096"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.params, check.DeepEquals, map[string]string{"memory": "4096", "verbose": "true"})
+}
+
+func (s *S) TestInstallWithTemplateOfOtherIaas(c *check.C) {
+	err := installer.AddTemplate(installer.Template{Name: "large", Iaas: "test-iaas"})
+	c.Assert(err, check.IsNil)
+	command := install{}
+	err = command.Flags().Parse(true, []string{"--template", "large", "--iaas", "ec2"})
+	c.Assert(err, check.IsNil)
+	err = command.Run(&cmd.Context{Stdout: ioutil.Discard, Stderr: ioutil.Discard}, nil)
+	c.Assert(err, check.ErrorMatches, `template "large" uses iaas "test-iaas", not "ec2"`)
+}
+
+func (s *S) TestInstallWithTemplateNotFound(c *check.C) {
+	command := install{template: "large"}
+	err := command.Run(&cmd.Context{Stdout: ioutil.Discard, Stderr: ioutil.Discard}, nil)
+	c.Assert(err, check.ErrorMatches, `template "large" not found`)
+}
+
+func (s *S) TestTemplateAdd(c *check.C) {
+	var stdout bytes.Buffer
+	context := cmd.Context{
+		Args:   []string{"large", "test-iaas", "memory=8192", "config=a=b"},
+		Stdout: &stdout,
+	}
+	err := (&templateAdd{}).Run(&context, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Template \"large\" added.\n")
+	t, err := installer.FindTemplate("large")
+	c.Assert(err, check.IsNil)
+	c.Assert(t, check.DeepEquals, &installer.Template{
+		Name:   "large",
+		Iaas:   "test-iaas",
+		Params: map[string]string{"memory": "8192", "config": "a=b"},
+	})
+}
+
+func (s *S) TestTemplateAddInvalidParam(c *check.C) {
+	context := cmd.Context{Args: []string{"large", "test-iaas", "memory"}, Stdout: ioutil.Discard}
+	err := (&templateAdd{}).Run(&context, nil)
+	c.Assert(err, check.ErrorMatches, `invalid param "memory", it must be in the form <param>=<value>`)
+}
+
+func (s *S) TestTemplateList(c *check.C) {
+	c.Assert(installer.AddTemplate(installer.Template{Name: "small", Iaas: "test-iaas"}), check.IsNil)
+	c.Assert(installer.AddTemplate(installer.Template{
+		Name:   "large",
+		Iaas:   "test-iaas",
+		Params: map[string]string{"memory": "8192", "verbose": "true"},
+	}), check.IsNil)
+	var stdout bytes.Buffer
+	err := (&templateList{}).Run(&cmd.Context{Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	expected := `+-------+-----------+--------------+
+| Name  | IaaS      | Params       |
++-------+-----------+--------------+
+| large | test-iaas | memory=8192  |
+|       |           | verbose=true |
++-------+-----------+--------------+
+| small | test-iaas |              |
++-------+-----------+--------------+
+`
+	c.Assert(stdout.String(), check.Equals, expected)
+}
+
+func (s *S) TestTemplateRemove(c *check.C) {
+	c.Assert(installer.AddTemplate(installer.Template{Name: "large", Iaas: "test-iaas"}), check.IsNil)
+	var stdout bytes.Buffer
+	err := (&templateRemove{}).Run(&cmd.Context{Args: []string{"large"}, Stdout: &stdout}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, "Template \"large\" removed.\n")
+	_, err = installer.FindTemplate("large")
+	c.Assert(err, check.NotNil)
+	err = (&templateRemove{}).Run(&cmd.Context{Args: []string{"large"}, Stdout: &stdout}, nil)
+	c.Assert(err, check.ErrorMatches, `template "large" not found`)
+}
+
+func (s *S) TestInstallAddsTarget(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	command := install{iaas: "test-iaas"}
+	err := command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	targets, err := ioutil.ReadFile(cmd.JoinWithUserDir(".tsuru", "targets"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(targets), check.Equals, fmt.Sprintf("tsuru\thttp://%s:8080\n", testProvider.address))
+}
+
+func (s *S) TestUninstallInfo(c *check.C) {
+	info := (&uninstall{}).Info()
+	c.Assert(info.Name, check.Equals, "uninstall")
+	c.Assert(info.MaxArgs, check.Equals, 1)
+}
+
+func (s *S) TestDestroyInfo(c *check.C) {
+	info := (&destroy{}).Info()
+	c.Assert(info.Name, check.Equals, "destroy")
+	c.Assert(info.Desc, check.Matches, "(?s).*alias to uninstall.*")
+}
+
+func (s *S) TestUninstall(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	err := (&install{iaas: "test-iaas"}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	stdout.Reset()
+	command := uninstall{}
+	command.Flags().Parse(true, []string{"-y"})
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Matches, `(?s).*Deleting machine test-machine.*Installation "tsuru" destroyed.\n`)
+	_, err = installer.LoadState("tsuru")
+	c.Assert(err, check.NotNil)
+	targets, err := ioutil.ReadFile(cmd.JoinWithUserDir(".tsuru", "targets"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(targets), check.Equals, "")
+}
+
+func (s *S) TestUninstallAsksForConfirmation(c *check.C) {
+	var stdout, stderr bytes.Buffer
+	context := cmd.Context{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	err := (&install{iaas: "test-iaas"}).Run(&context, client)
+	c.Assert(err, check.IsNil)
+	stdout.Reset()
+	context.Stdin = strings.NewReader("n\n")
+	command := uninstall{}
+	err = command.Run(&context, client)
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout.String(), check.Equals, `Are you sure you want to destroy the installation "tsuru" and its 1 machine(s)? (y/n) Abort.`+"\n")
+	_, err = installer.LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestUninstallNotFound(c *check.C) {
+	context := cmd.Context{Args: []string{"staging"}}
+	client := cmd.NewClient(&http.Client{}, nil, manager)
+	err := (&uninstall{}).Run(&context, client)
+	c.Assert(err, check.ErrorMatches, `installation "staging" not found`)
+}
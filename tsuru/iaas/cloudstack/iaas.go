@@ -0,0 +1,413 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloudstack
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/dockertls"
+)
+
+const (
+	defaultWaitTimeout = 300
+	// yatiTag is the tag added to the virtual machines created by yati, so
+	// they can be listed.
+	yatiTag = "yati"
+)
+
+const (
+	jobInProgress = 0
+	jobFailed     = 2
+)
+
+// pollInterval is the time between checks of an async job.
+var pollInterval = 2 * time.Second
+
+// waitDocker waits for the Docker daemon installed when the virtual machine
+// boots.
+var waitDocker = dockertls.Wait
+
+func init() {
+	iaas.MustRegister("cloudstack", &csIaas{})
+}
+
+// csIaas deploys virtual machines in CloudStack. The API URL and keys are
+// read from CLOUDSTACK_API_URL, CLOUDSTACK_API_KEY and CLOUDSTACK_SECRET_KEY
+// unless they're set. The api-url param overrides the URL.
+type csIaas struct {
+	url       string
+	apiKey    string
+	secretKey string
+}
+
+// apiError is an error returned by the CloudStack API.
+type apiError struct {
+	Command string
+	Code    int    `json:"errorcode"`
+	Text    string `json:"errortext"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("cloudstack %s failed with code %d: %s", e.Command, e.Code, e.Text)
+}
+
+type virtualMachine struct {
+	ID    string `json:"id"`
+	State string `json:"state"`
+	Nic   []struct {
+		IPAddress string `json:"ipaddress"`
+	} `json:"nic"`
+}
+
+type asyncJob struct {
+	ID    string `json:"id"`
+	JobID string `json:"jobid"`
+}
+
+type asyncJobResult struct {
+	JobStatus int             `json:"jobstatus"`
+	JobResult json.RawMessage `json:"jobresult"`
+}
+
+func (i *csIaas) Describe() string {
+	return fmt.Sprintf(`CloudStack IaaS required params:
+  zone=<zone id>                         Zone of the virtual machine
+  template=<template id>                 Template of the virtual machine
+  service-offering=<offering id>         Service offering of the virtual machine
+
+Optional params:
+  network=<network ids>                  Comma separated ids of networks
+  project=<project id>                   Project of the virtual machine
+  name=<name>                            Name of the virtual machine
+  user-data=<data>                       User data given to the virtual machine
+  wait-timeout=<seconds>                 Time to wait for the deploy and its Docker, defaults to %d
+  api-url=<url>                          CloudStack API URL
+
+The API URL and keys are read from CLOUDSTACK_API_URL, CLOUDSTACK_API_KEY
+and CLOUDSTACK_SECRET_KEY. Docker is installed with TLS when the virtual
+machine boots, listening on the port %d.
+`, defaultWaitTimeout, dockertls.Port)
+}
+
+func (i *csIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "zone", Usage: "Zone of the virtual machine", Required: true},
+		{Name: "template", Usage: "Template of the virtual machine", Required: true},
+		{Name: "service-offering", Usage: "Service offering of the virtual machine", Required: true},
+		{Name: "network", Usage: "Comma separated ids of networks"},
+		{Name: "project", Usage: "Project of the virtual machine"},
+		{Name: "name", Usage: "Name of the virtual machine"},
+		{Name: "user-data", Usage: "User data given to the virtual machine"},
+		{Name: "wait-timeout", Usage: "Time to wait for the deploy and its Docker, in seconds", Type: iaas.IntFlag, Value: strconv.Itoa(defaultWaitTimeout)},
+		{Name: "api-url", Usage: "CloudStack API URL"},
+	}
+}
+
+// deployParams returns the deployVirtualMachine params for the yati params.
+// The user data is added by CreateMachine.
+func deployParams(params map[string]string) (map[string]string, error) {
+	names := map[string]string{
+		"zone":             "zoneid",
+		"template":         "templateid",
+		"service-offering": "serviceofferingid",
+		"network":          "networkids",
+		"project":          "projectid",
+		"name":             "name",
+	}
+	for _, name := range []string{"zone", "template", "service-offering"} {
+		if params[name] == "" {
+			return nil, fmt.Errorf("the parameter %q is required", name)
+		}
+	}
+	result := make(map[string]string)
+	for name, csName := range names {
+		if v := params[name]; v != "" {
+			result[csName] = v
+		}
+	}
+	return result, nil
+}
+
+// CreateMachine deploys a virtual machine and waits for the deploy job.
+// Docker is installed with TLS by the user data of the virtual machine, run
+// before the one in the user-data param, and the machine is only returned
+// when it answers. Its client certificates are kept in
+// ~/.yati/cloudstack/<virtual machine id>.
+func (i *csIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	deploy, err := deployParams(params)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := iaas.IntParam(params, "wait-timeout", defaultWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := dockertls.GenerateCerts(dockertls.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate Docker certificates: %s", err)
+	}
+	userData, err := dockertls.UserData(certs, params["user-data"])
+	if err != nil {
+		return nil, err
+	}
+	deploy["userdata"] = base64.StdEncoding.EncodeToString([]byte(userData))
+	apiURL := params["api-url"]
+	var job asyncJob
+	err = i.do(apiURL, "deployVirtualMachine", deploy, &job)
+	if err != nil {
+		return nil, err
+	}
+	err = i.waitJob(apiURL, job.JobID, time.Duration(timeout)*time.Second)
+	if err == nil {
+		err = i.tag(apiURL, job.ID, time.Duration(timeout)*time.Second)
+	}
+	var vm *virtualMachine
+	if err == nil {
+		vm, err = i.getVirtualMachine(apiURL, job.ID, params["project"])
+	}
+	dir := dockertls.CertsDir("cloudstack", job.ID)
+	if err == nil {
+		m := machine(vm)
+		m.CreationParams = params
+		m.TLSServerName = dockertls.ServerName
+		err = dockertls.Save(dir, certs, dockertls.Port, m)
+		if err == nil {
+			err = waitDocker(m, time.Duration(timeout)*time.Second)
+		}
+		if err == nil {
+			return m, nil
+		}
+	}
+	i.destroy(apiURL, job.ID, time.Duration(timeout)*time.Second)
+	os.RemoveAll(dir)
+	return nil, err
+}
+
+// DeleteMachine destroys and expunges the virtual machine, and removes its
+// client certificates. Machines that are already gone are ignored.
+func (i *csIaas) DeleteMachine(m *iaas.Machine) error {
+	apiURL := m.CreationParams["api-url"]
+	err := i.destroy(apiURL, m.Id, defaultWaitTimeout*time.Second)
+	if _, ok := err.(*apiError); ok {
+		if _, getErr := i.getVirtualMachine(apiURL, m.Id, m.CreationParams["project"]); getErr == iaas.ErrMachineNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dockertls.CertsDir("cloudstack", m.Id))
+}
+
+// tag adds yatiTag to the virtual machine.
+func (i *csIaas) tag(apiURL, id string, timeout time.Duration) error {
+	var job asyncJob
+	err := i.do(apiURL, "createTags", map[string]string{
+		"resourceids":   id,
+		"resourcetype":  "UserVm",
+		"tags[0].key":   yatiTag,
+		"tags[0].value": "true",
+	}, &job)
+	if err != nil {
+		return err
+	}
+	return i.waitJob(apiURL, job.JobID, timeout)
+}
+
+func (i *csIaas) destroy(apiURL, id string, timeout time.Duration) error {
+	var job asyncJob
+	err := i.do(apiURL, "destroyVirtualMachine", map[string]string{"id": id, "expunge": "true"}, &job)
+	if err != nil {
+		return err
+	}
+	return i.waitJob(apiURL, job.JobID, timeout)
+}
+
+// ListMachines returns the virtual machines tagged by CreateMachine, in the
+// API and project of the params.
+func (i *csIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	var resp struct {
+		VirtualMachine []virtualMachine `json:"virtualmachine"`
+	}
+	query := map[string]string{
+		"listall":       "true",
+		"tags[0].key":   yatiTag,
+		"tags[0].value": "true",
+	}
+	if project := params["project"]; project != "" {
+		query["projectid"] = project
+	}
+	err := i.do(params["api-url"], "listVirtualMachines", query, &resp)
+	if err != nil {
+		return nil, err
+	}
+	machines := []*iaas.Machine{}
+	for j := range resp.VirtualMachine {
+		m := machine(&resp.VirtualMachine[j])
+		m.CreationParams = params
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+func (i *csIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	vm, err := i.getVirtualMachine(m.CreationParams["api-url"], m.Id, m.CreationParams["project"])
+	if err != nil {
+		return nil, err
+	}
+	current := machine(vm)
+	current.CreationParams = m.CreationParams
+	return current, nil
+}
+
+func (i *csIaas) getVirtualMachine(apiURL, id, project string) (*virtualMachine, error) {
+	params := map[string]string{"id": id}
+	if project != "" {
+		params["projectid"] = project
+	}
+	var resp struct {
+		VirtualMachine []virtualMachine `json:"virtualmachine"`
+	}
+	err := i.do(apiURL, "listVirtualMachines", params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.VirtualMachine) == 0 {
+		return nil, iaas.ErrMachineNotFound
+	}
+	return &resp.VirtualMachine[0], nil
+}
+
+// waitJob polls the async job until it's finished.
+func (i *csIaas) waitJob(apiURL, jobID string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var result asyncJobResult
+		err := i.do(apiURL, "queryAsyncJobResult", map[string]string{"jobid": jobID}, &result)
+		if err != nil {
+			return err
+		}
+		switch result.JobStatus {
+		case jobInProgress:
+		case jobFailed:
+			var e apiError
+			json.Unmarshal(result.JobResult, &e)
+			return fmt.Errorf("cloudstack job %s failed: %s", jobID, e.Text)
+		default:
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %s waiting for cloudstack job %s", timeout, jobID)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func machine(vm *virtualMachine) *iaas.Machine {
+	m := &iaas.Machine{
+		Id:     vm.ID,
+		Iaas:   "cloudstack",
+		Status: strings.ToLower(vm.State),
+	}
+	if len(vm.Nic) > 0 {
+		m.Address = vm.Nic[0].IPAddress
+	}
+	return m
+}
+
+func (i *csIaas) credentials(apiURL string) (string, string, string, error) {
+	if apiURL == "" {
+		apiURL = i.url
+	}
+	if apiURL == "" {
+		apiURL = os.Getenv("CLOUDSTACK_API_URL")
+	}
+	apiKey, secretKey := i.apiKey, i.secretKey
+	if apiKey == "" {
+		apiKey = os.Getenv("CLOUDSTACK_API_KEY")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("CLOUDSTACK_SECRET_KEY")
+	}
+	if apiURL == "" || apiKey == "" || secretKey == "" {
+		return "", "", "", fmt.Errorf("CLOUDSTACK_API_URL, CLOUDSTACK_API_KEY and CLOUDSTACK_SECRET_KEY must be set")
+	}
+	return apiURL, apiKey, secretKey, nil
+}
+
+// do runs the command and decodes its response into result.
+func (i *csIaas) do(apiURL, command string, params map[string]string, result interface{}) error {
+	apiURL, apiKey, secretKey, err := i.credentials(apiURL)
+	if err != nil {
+		return err
+	}
+	query := make(map[string]string, len(params)+3)
+	for k, v := range params {
+		query[k] = v
+	}
+	query["command"] = command
+	query["response"] = "json"
+	query["apiKey"] = apiKey
+	// The query is posted, since GET requests limit the user data to 2KB.
+	resp, err := http.Post(apiURL, "application/x-www-form-urlencoded", strings.NewReader(signedQuery(query, secretKey)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var envelope map[string]json.RawMessage
+	err = json.Unmarshal(body, &envelope)
+	if err != nil {
+		return fmt.Errorf("invalid response for cloudstack %s (status %d): %s", command, resp.StatusCode, body)
+	}
+	data := envelope[strings.ToLower(command)+"response"]
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{Command: command, Code: resp.StatusCode}
+		json.Unmarshal(data, e)
+		return e
+	}
+	if data == nil {
+		return fmt.Errorf("invalid response for cloudstack %s: %s", command, body)
+	}
+	return json.Unmarshal(data, result)
+}
+
+// signedQuery returns the query string with the signature of the params.
+func signedQuery(params map[string]string, secretKey string) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for j, k := range keys {
+		parts[j] = k + "=" + escape(params[k])
+	}
+	query := strings.Join(parts, "&")
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(strings.ToLower(query)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return query + "&signature=" + escape(signature)
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
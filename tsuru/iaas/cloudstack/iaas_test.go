@@ -0,0 +1,317 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cloudstack
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	home     string
+	server   *httptest.Server
+	cs       *fakeCloudStack
+	provider *csIaas
+	// waited are the machines whose Docker was waited for.
+	waited []*iaas.Machine
+	// dockerErr is returned by waitDocker.
+	dockerErr error
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	pollInterval = time.Millisecond
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	s.waited = nil
+	s.dockerErr = nil
+	waitDocker = func(m *iaas.Machine, timeout time.Duration) error {
+		s.waited = append(s.waited, m)
+		return s.dockerErr
+	}
+	s.cs = &fakeCloudStack{vms: make(map[string]string), tagged: make(map[string]bool), jobs: make(map[string]int), pending: 1}
+	s.server = httptest.NewServer(s.cs)
+	s.provider = &csIaas{url: s.server.URL, apiKey: "key", secretKey: "secret"}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.Close()
+}
+
+func (s *S) params() map[string]string {
+	return map[string]string{
+		"zone":             "zone-1",
+		"template":         "template-1",
+		"service-offering": "offering-1",
+		"network":          "net-1,net-2",
+		"user-data":        "#!/bin/sh",
+	}
+}
+
+// fakeCloudStack is a stand-in for the CloudStack API that checks the
+// signature of every request. Jobs stay in progress for the given number of
+// queries.
+type fakeCloudStack struct {
+	mu       sync.Mutex
+	vms      map[string]string
+	tagged   map[string]bool
+	jobs     map[string]int
+	pending  int
+	failJob  bool
+	commands []string
+	deployed map[string]string
+}
+
+func (f *fakeCloudStack) reply(w http.ResponseWriter, command string, status int, data interface{}) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{strings.ToLower(command) + "response": data})
+}
+
+func (f *fakeCloudStack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	query := r.PostForm
+	params := make(map[string]string)
+	for k := range query {
+		if k != "signature" {
+			params[k] = query.Get(k)
+		}
+	}
+	command := params["command"]
+	f.commands = append(f.commands, command)
+	expected := signedQuery(params, "secret")
+	if !strings.HasSuffix(expected, "&signature="+escape(query.Get("signature"))) || params["apiKey"] != "key" {
+		f.reply(w, command, 401, map[string]interface{}{"errorcode": 401, "errortext": "unable to verify user credentials"})
+		return
+	}
+	switch command {
+	case "deployVirtualMachine":
+		f.deployed = params
+		id := fmt.Sprintf("vm-%d", len(f.vms)+1)
+		f.vms[id] = "Running"
+		f.jobs["job-"+id] = f.pending
+		f.reply(w, command, 200, map[string]string{"id": id, "jobid": "job-" + id})
+	case "destroyVirtualMachine":
+		id := params["id"]
+		if _, ok := f.vms[id]; !ok {
+			f.reply(w, command, 431, map[string]interface{}{"errorcode": 431, "errortext": "Unable to find virtual machine"})
+			return
+		}
+		delete(f.vms, id)
+		f.jobs["destroy-"+id] = 0
+		f.reply(w, command, 200, map[string]string{"jobid": "destroy-" + id})
+	case "createTags":
+		id := params["resourceids"]
+		if params["resourcetype"] == "UserVm" && params["tags[0].key"] == "yati" && params["tags[0].value"] == "true" {
+			f.tagged[id] = true
+		}
+		f.jobs["tag-"+id] = 0
+		f.reply(w, command, 200, map[string]string{"jobid": "tag-" + id})
+	case "queryAsyncJobResult":
+		id := params["jobid"]
+		status := 1
+		if f.jobs[id] > 0 {
+			f.jobs[id]--
+			status = 0
+		} else if f.failJob {
+			status = 2
+		}
+		f.reply(w, command, 200, map[string]interface{}{
+			"jobstatus": status,
+			"jobresult": map[string]interface{}{"errorcode": 530, "errortext": "insufficient capacity"},
+		})
+	case "listVirtualMachines":
+		var vms []map[string]interface{}
+		for id, state := range f.vms {
+			if params["id"] != "" && params["id"] != id {
+				continue
+			}
+			if params["tags[0].key"] == "yati" && !f.tagged[id] {
+				continue
+			}
+			vms = append(vms, map[string]interface{}{
+				"id":    id,
+				"state": state,
+				"nic":   []map[string]string{{"ipaddress": "10.1.1.10"}},
+			})
+		}
+		f.reply(w, command, 200, map[string]interface{}{"count": len(vms), "virtualmachine": vms})
+	default:
+		f.reply(w, command, 432, map[string]interface{}{"errorcode": 432, "errortext": "unknown command"})
+	}
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := s.params()
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	dir := filepath.Join(os.Getenv("HOME"), ".yati", "cloudstack", "vm-1")
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             "vm-1",
+		Iaas:           "cloudstack",
+		Status:         "running",
+		Address:        "10.1.1.10",
+		Port:           2376,
+		CreationParams: params,
+		CaCert:         filepath.Join(dir, "ca.pem"),
+		ClientCert:     filepath.Join(dir, "cert.pem"),
+		ClientKey:      filepath.Join(dir, "key.pem"),
+		TLSServerName:  "docker.yati",
+	})
+	c.Assert(s.waited, check.DeepEquals, []*iaas.Machine{m})
+	c.Assert(s.cs.commands, check.DeepEquals, []string{"deployVirtualMachine", "queryAsyncJobResult", "queryAsyncJobResult", "createTags", "queryAsyncJobResult", "listVirtualMachines"})
+	c.Assert(s.cs.tagged, check.DeepEquals, map[string]bool{"vm-1": true})
+	c.Assert(s.cs.deployed["zoneid"], check.Equals, "zone-1")
+	c.Assert(s.cs.deployed["templateid"], check.Equals, "template-1")
+	c.Assert(s.cs.deployed["serviceofferingid"], check.Equals, "offering-1")
+	c.Assert(s.cs.deployed["networkids"], check.Equals, "net-1,net-2")
+	userData, err := base64.StdEncoding.DecodeString(s.cs.deployed["userdata"])
+	c.Assert(err, check.IsNil)
+	c.Assert(string(userData), check.Matches, "(?s)Content-Type: multipart/mixed; .*get.docker.com.*tcp://0.0.0.0:2376 --tlsverify .*\r\n\r\n#!/bin/sh\r\n.*")
+}
+
+func (s *S) TestCreateMachineDockerTimeout(c *check.C) {
+	s.dockerErr = errors.New("timeout waiting for Docker")
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "timeout waiting for Docker")
+	c.Assert(s.cs.vms, check.HasLen, 0)
+	_, err = os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "cloudstack", "vm-1"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestCreateMachineRequiredParams(c *check.C) {
+	params := s.params()
+	delete(params, "template")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, `the parameter "template" is required`)
+	c.Assert(s.cs.commands, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineJobFailure(c *check.C) {
+	s.cs.failJob = true
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "cloudstack job job-vm-1 failed: insufficient capacity")
+	c.Assert(s.cs.vms, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineTimeout(c *check.C) {
+	s.cs.pending = 1000
+	params := s.params()
+	params["wait-timeout"] = "0"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "timeout after 0s waiting for cloudstack job job-vm-1")
+	c.Assert(s.cs.vms, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineInvalidCredentials(c *check.C) {
+	s.provider.secretKey = "wrong"
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "cloudstack deployVirtualMachine failed with code 401: unable to verify user credentials")
+}
+
+func (s *S) TestCreateMachineWithoutCredentials(c *check.C) {
+	s.provider.apiKey = ""
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "CLOUDSTACK_API_URL, CLOUDSTACK_API_KEY and CLOUDSTACK_SECRET_KEY must be set")
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cs.vms, check.HasLen, 0)
+	c.Assert(s.cs.commands[len(s.cs.commands)-2:], check.DeepEquals, []string{"destroyVirtualMachine", "queryAsyncJobResult"})
+	_, err = os.Stat(filepath.Dir(m.CaCert))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestDeleteMachineNotFound(c *check.C) {
+	err := s.provider.DeleteMachine(&iaas.Machine{Id: "vm-10"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDeleteMachineError(c *check.C) {
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	s.provider.secretKey = "wrong"
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.ErrorMatches, "cloudstack destroyVirtualMachine failed with code 401: unable to verify user credentials")
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	s.cs.vms["vm-2"] = "Running"
+	machines, err := s.provider.ListMachines(s.params())
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.DeepEquals, []*iaas.Machine{{Id: "vm-1", Iaas: "cloudstack", Status: "running", Address: "10.1.1.10", CreationParams: s.params()}})
+}
+
+func (s *S) TestListMachinesAPIURLParam(c *check.C) {
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	apiURL := s.provider.url
+	s.provider.url = "http://127.0.0.1:1"
+	defer func() { s.provider.url = apiURL }()
+	params := s.params()
+	params["api-url"] = apiURL
+	machines, err := s.provider.ListMachines(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 1)
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	created, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	m, err := s.provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Address, check.Equals, "10.1.1.10")
+	c.Assert(m.CreationParams, check.DeepEquals, s.params())
+	_, err = s.provider.GetMachine(&iaas.Machine{Id: "vm-10", CreationParams: s.params()})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestSignedQuery(c *check.C) {
+	query := signedQuery(map[string]string{
+		"command":  "deployVirtualMachine",
+		"name":     "tsuru 1",
+		"response": "json",
+		"apiKey":   "key",
+	}, "secret")
+	c.Assert(query, check.Equals, "apiKey=key&command=deployVirtualMachine&name=tsuru%201&response=json&signature=AeMhSh%2F2Rvz2BqmAcHvcxGw%2FOVo%3D")
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("cloudstack")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s)CloudStack IaaS required params:.*")
+}
+
+func (s *S) TestCheckDocker(c *check.C) {
+	err := iaas.CheckDocker("cloudstack", s.params())
+	c.Assert(err, check.IsNil)
+}
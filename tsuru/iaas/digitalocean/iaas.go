@@ -0,0 +1,308 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package digitalocean
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/dockertls"
+	"github.com/digitalocean/godo"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultRegion      = "nyc3"
+	defaultSize        = "2gb"
+	defaultImage       = "ubuntu-16-04-x64"
+	defaultWaitTimeout = 300
+
+	// namePrefix starts the name of the droplets created by yati, so
+	// ListMachines leaves the other droplets of the account out.
+	namePrefix = "yati-"
+)
+
+// pollInterval is the time between checks of the droplet status.
+var pollInterval = 5 * time.Second
+
+// waitDocker waits for the Docker daemon installed when the droplet boots.
+var waitDocker = dockertls.Wait
+
+func init() {
+	iaas.MustRegister("digitalocean", &doIaas{})
+}
+
+// doIaas creates droplets in DigitalOcean. The access token is read from
+// DIGITALOCEAN_ACCESS_TOKEN unless token is set. The API is the one in the
+// api-url param.
+type doIaas struct {
+	token string
+}
+
+func (i *doIaas) Describe() string {
+	return fmt.Sprintf(`DigitalOcean IaaS optional params:
+  name=<name>                Name of the droplet, prefixed with %s,
+                             defaults to a random name
+  region=<region>            Region of the droplet, defaults to %s
+  size=<size>                Size of the droplet, defaults to %s
+  image=<image>              Image slug, defaults to %s
+  ssh-keys=<keys>            Comma separated ids or fingerprints of SSH keys
+  user-data=<data>           User data given to the droplet
+  wait-timeout=<seconds>     Time to wait for the droplet and its Docker, defaults to %d
+  api-url=<url>              DigitalOcean API URL
+
+The access token is read from DIGITALOCEAN_ACCESS_TOKEN. Docker is installed
+with TLS when the droplet boots, listening on the port %d.
+`, namePrefix, defaultRegion, defaultSize, defaultImage, defaultWaitTimeout, dockertls.Port)
+}
+
+func (i *doIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "name", Usage: "Name of the droplet, prefixed with " + namePrefix + ", defaults to a random name"},
+		{Name: "region", Usage: "Region of the droplet", Value: defaultRegion},
+		{Name: "size", Usage: "Size of the droplet", Value: defaultSize},
+		{Name: "image", Usage: "Image slug", Value: defaultImage},
+		{Name: "ssh-keys", Usage: "Comma separated ids or fingerprints of SSH keys"},
+		{Name: "user-data", Usage: "User data given to the droplet"},
+		{Name: "wait-timeout", Usage: "Time to wait for the droplet and its Docker, in seconds", Type: iaas.IntFlag, Value: strconv.Itoa(defaultWaitTimeout)},
+		{Name: "api-url", Usage: "DigitalOcean API URL"},
+	}
+}
+
+func (i *doIaas) client(apiURL string) (*godo.Client, error) {
+	token := i.token
+	if token == "" {
+		token = os.Getenv("DIGITALOCEAN_ACCESS_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("DIGITALOCEAN_ACCESS_TOKEN is not set")
+	}
+	httpClient := &http.Client{
+		Transport: &oauth2.Transport{
+			Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+		},
+	}
+	client := godo.NewClient(httpClient)
+	if apiURL != "" {
+		u, err := url.Parse(strings.TrimSuffix(apiURL, "/") + "/")
+		if err != nil {
+			return nil, err
+		}
+		client.BaseURL = u
+	}
+	return client, nil
+}
+
+// buildCreateRequest returns the request used to create the droplet
+// described by params.
+func buildCreateRequest(params map[string]string) (*godo.DropletCreateRequest, error) {
+	request := &godo.DropletCreateRequest{
+		Name:     params["name"],
+		Region:   params["region"],
+		Size:     params["size"],
+		Image:    godo.DropletCreateImage{Slug: params["image"]},
+		UserData: params["user-data"],
+	}
+	if request.Name == "" {
+		b := make([]byte, 4)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		request.Name = hex.EncodeToString(b)
+	}
+	if !strings.HasPrefix(request.Name, namePrefix) {
+		request.Name = namePrefix + request.Name
+	}
+	if request.Region == "" {
+		request.Region = defaultRegion
+	}
+	if request.Size == "" {
+		request.Size = defaultSize
+	}
+	if request.Image.Slug == "" {
+		request.Image.Slug = defaultImage
+	}
+	if keys := params["ssh-keys"]; keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			if id, err := strconv.Atoi(key); err == nil {
+				request.SSHKeys = append(request.SSHKeys, godo.DropletCreateSSHKey{ID: id})
+			} else {
+				request.SSHKeys = append(request.SSHKeys, godo.DropletCreateSSHKey{Fingerprint: key})
+			}
+		}
+	}
+	return request, nil
+}
+
+// CreateMachine creates a droplet and waits for it to be active. Docker is
+// installed with TLS by the user data of the droplet, run before the one in
+// the user-data param, and the machine is only returned when it answers.
+// Its client certificates are kept in ~/.yati/digitalocean/<droplet id>.
+func (i *doIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	request, err := buildCreateRequest(params)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := iaas.IntParam(params, "wait-timeout", defaultWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := dockertls.GenerateCerts(dockertls.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate Docker certificates: %s", err)
+	}
+	request.UserData, err = dockertls.UserData(certs, request.UserData)
+	if err != nil {
+		return nil, err
+	}
+	client, err := i.client(params["api-url"])
+	if err != nil {
+		return nil, err
+	}
+	droplet, _, err := client.Droplets.Create(request)
+	if err != nil {
+		return nil, err
+	}
+	id := droplet.ID
+	dir := dockertls.CertsDir("digitalocean", strconv.Itoa(id))
+	droplet, err = waitActive(client, id, time.Duration(timeout)*time.Second)
+	if err == nil {
+		m := machine(droplet)
+		m.CreationParams = params
+		m.TLSServerName = dockertls.ServerName
+		err = dockertls.Save(dir, certs, dockertls.Port, m)
+		if err == nil {
+			err = waitDocker(m, time.Duration(timeout)*time.Second)
+		}
+		if err == nil {
+			return m, nil
+		}
+	}
+	client.Droplets.Delete(id)
+	os.RemoveAll(dir)
+	return nil, err
+}
+
+// DeleteMachine destroys the droplet and removes its client certificates.
+func (i *doIaas) DeleteMachine(m *iaas.Machine) error {
+	id, err := strconv.Atoi(m.Id)
+	if err != nil {
+		return fmt.Errorf("invalid droplet id %q", m.Id)
+	}
+	client, err := i.client(m.CreationParams["api-url"])
+	if err != nil {
+		return err
+	}
+	_, err = client.Droplets.Delete(id)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return os.RemoveAll(dockertls.CertsDir("digitalocean", m.Id))
+}
+
+// ListMachines returns the droplets created by yati, the ones whose name
+// starts with namePrefix.
+func (i *doIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	client, err := i.client(params["api-url"])
+	if err != nil {
+		return nil, err
+	}
+	machines := []*iaas.Machine{}
+	opt := &godo.ListOptions{Page: 1}
+	for {
+		droplets, resp, err := client.Droplets.List(opt)
+		if err != nil {
+			return nil, err
+		}
+		for j := range droplets {
+			if strings.HasPrefix(droplets[j].Name, namePrefix) {
+				m := machine(&droplets[j])
+				m.CreationParams = params
+				machines = append(machines, m)
+			}
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
+			return machines, nil
+		}
+		opt.Page++
+	}
+}
+
+func (i *doIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	dropletID, err := strconv.Atoi(m.Id)
+	if err != nil {
+		return nil, iaas.ErrMachineNotFound
+	}
+	client, err := i.client(m.CreationParams["api-url"])
+	if err != nil {
+		return nil, err
+	}
+	droplet, _, err := client.Droplets.Get(dropletID)
+	if isNotFound(err) {
+		return nil, iaas.ErrMachineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	current := machine(droplet)
+	current.CreationParams = m.CreationParams
+	return current, nil
+}
+
+// waitActive polls the droplet until it's active and has a public address.
+// The droplet is returned even on errors, so it can be destroyed.
+func waitActive(client *godo.Client, id int, timeout time.Duration) (*godo.Droplet, error) {
+	deadline := time.Now().Add(timeout)
+	droplet := &godo.Droplet{ID: id}
+	for {
+		current, _, err := client.Droplets.Get(id)
+		if err != nil {
+			return droplet, err
+		}
+		droplet = current
+		if droplet.Status == "active" && publicAddress(droplet) != "" {
+			return droplet, nil
+		}
+		if time.Now().After(deadline) {
+			return droplet, fmt.Errorf("timeout after %s waiting for droplet %d to be active", timeout, id)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func publicAddress(droplet *godo.Droplet) string {
+	if droplet.Networks == nil {
+		return ""
+	}
+	for _, n := range droplet.Networks.V4 {
+		if n.Type == "public" {
+			return n.IPAddress
+		}
+	}
+	return ""
+}
+
+func machine(droplet *godo.Droplet) *iaas.Machine {
+	return &iaas.Machine{
+		Id:      strconv.Itoa(droplet.ID),
+		Iaas:    "digitalocean",
+		Status:  droplet.Status,
+		Address: publicAddress(droplet),
+	}
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*godo.ErrorResponse)
+	return ok && e.Response != nil && e.Response.StatusCode == http.StatusNotFound
+}
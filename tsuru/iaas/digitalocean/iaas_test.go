@@ -0,0 +1,288 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package digitalocean
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/digitalocean/godo"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	home     string
+	server   *httptest.Server
+	do       *fakeDO
+	provider *doIaas
+	// waited are the machines whose Docker was waited for.
+	waited []*iaas.Machine
+	// dockerErr is returned by waitDocker.
+	dockerErr error
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	pollInterval = time.Millisecond
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	s.waited = nil
+	s.dockerErr = nil
+	waitDocker = func(m *iaas.Machine, timeout time.Duration) error {
+		s.waited = append(s.waited, m)
+		return s.dockerErr
+	}
+	s.do = &fakeDO{droplets: make(map[int]*fakeDroplet), pending: 1}
+	s.server = httptest.NewServer(s.do)
+	s.provider = &doIaas{token: "secret"}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.Close()
+}
+
+func (s *S) params() map[string]string {
+	return map[string]string{
+		"api-url":   s.server.URL,
+		"name":      "tsuru-1",
+		"region":    "sfo1",
+		"size":      "4gb",
+		"image":     "ubuntu-16-04-x64",
+		"ssh-keys":  "123,aa:bb:cc",
+		"user-data": "#!/bin/sh\necho hi",
+	}
+}
+
+type fakeDroplet struct {
+	name    string
+	pending int
+}
+
+// fakeDO is a stand-in for the DigitalOcean API. Droplets stay new for the
+// given number of requests before being active.
+type fakeDO struct {
+	mu       sync.Mutex
+	droplets map[int]*fakeDroplet
+	nextID   int
+	pending  int
+	requests []string
+	created  godo.DropletCreateRequest
+	tokens   []string
+}
+
+func (f *fakeDO) droplet(id int) map[string]interface{} {
+	d := f.droplets[id]
+	droplet := map[string]interface{}{"id": id, "name": d.name, "status": "new"}
+	if d.pending > 0 {
+		d.pending--
+		return droplet
+	}
+	droplet["status"] = "active"
+	droplet["networks"] = map[string]interface{}{
+		"v4": []map[string]string{
+			{"ip_address": "10.0.0.1", "type": "private"},
+			{"ip_address": "104.0.0.1", "type": "public"},
+		},
+	}
+	return droplet
+}
+
+func (f *fakeDO) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.tokens = append(f.tokens, r.Header.Get("Authorization"))
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/v2/droplets" {
+		switch r.Method {
+		case "POST":
+			json.NewDecoder(r.Body).Decode(&f.created)
+			f.nextID++
+			f.droplets[f.nextID] = &fakeDroplet{name: f.created.Name, pending: f.pending}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]interface{}{"droplet": map[string]interface{}{"id": f.nextID, "status": "new"}})
+		case "GET":
+			var droplets []map[string]interface{}
+			for id := 1; id <= f.nextID; id++ {
+				if _, ok := f.droplets[id]; ok {
+					droplets = append(droplets, f.droplet(id))
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"droplets": droplets})
+		}
+		return
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v2/droplets/"))
+	if _, ok := f.droplets[id]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"id": "not_found", "message": "The resource you were accessing could not be found."}`)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"droplet": f.droplet(id)})
+	case "DELETE":
+		delete(f.droplets, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := s.params()
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	dir := filepath.Join(os.Getenv("HOME"), ".yati", "digitalocean", "1")
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             "1",
+		Iaas:           "digitalocean",
+		Status:         "active",
+		Address:        "104.0.0.1",
+		Port:           2376,
+		CreationParams: params,
+		CaCert:         filepath.Join(dir, "ca.pem"),
+		ClientCert:     filepath.Join(dir, "cert.pem"),
+		ClientKey:      filepath.Join(dir, "key.pem"),
+		TLSServerName:  "docker.yati",
+	})
+	c.Assert(s.waited, check.DeepEquals, []*iaas.Machine{m})
+	c.Assert(s.do.requests, check.DeepEquals, []string{"POST /v2/droplets", "GET /v2/droplets/1", "GET /v2/droplets/1"})
+	c.Assert(s.do.tokens[0], check.Equals, "Bearer secret")
+	created := s.do.created
+	c.Assert(created.Name, check.Equals, "yati-tsuru-1")
+	c.Assert(created.Region, check.Equals, "sfo1")
+	c.Assert(created.Size, check.Equals, "4gb")
+	c.Assert(created.UserData, check.Matches, "(?s)Content-Type: multipart/mixed; .*get.docker.com.*tcp://0.0.0.0:2376 --tlsverify .*\r\n\r\n#!/bin/sh\necho hi\r\n.*")
+}
+
+func (s *S) TestCreateMachineWithoutUserData(c *check.C) {
+	params := s.params()
+	delete(params, "user-data")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.do.created.UserData, check.Matches, "(?s)#!/bin/sh\nset -e\n.*get.docker.com.*")
+}
+
+func (s *S) TestCreateMachineDockerTimeout(c *check.C) {
+	s.dockerErr = errors.New("timeout waiting for Docker")
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "timeout waiting for Docker")
+	c.Assert(s.do.requests[len(s.do.requests)-1], check.Equals, "DELETE /v2/droplets/1")
+	c.Assert(s.do.droplets, check.HasLen, 0)
+	_, err = os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "digitalocean", "1"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestBuildCreateRequest(c *check.C) {
+	request, err := buildCreateRequest(s.params())
+	c.Assert(err, check.IsNil)
+	c.Assert(request.Image, check.Equals, godo.DropletCreateImage{Slug: "ubuntu-16-04-x64"})
+	c.Assert(request.SSHKeys, check.DeepEquals, []godo.DropletCreateSSHKey{{ID: 123}, {Fingerprint: "aa:bb:cc"}})
+}
+
+func (s *S) TestBuildCreateRequestDefaults(c *check.C) {
+	request, err := buildCreateRequest(map[string]string{})
+	c.Assert(err, check.IsNil)
+	c.Assert(request.Name, check.Matches, "yati-[0-9a-f]{8}")
+	c.Assert(request.Region, check.Equals, "nyc3")
+	c.Assert(request.Size, check.Equals, "2gb")
+	c.Assert(request.Image.Slug, check.Equals, "ubuntu-16-04-x64")
+	c.Assert(request.SSHKeys, check.HasLen, 0)
+}
+
+func (s *S) TestBuildCreateRequestPrefixedName(c *check.C) {
+	request, err := buildCreateRequest(map[string]string{"name": "yati-web"})
+	c.Assert(err, check.IsNil)
+	c.Assert(request.Name, check.Equals, "yati-web")
+}
+
+func (s *S) TestCreateMachineTimeout(c *check.C) {
+	s.do.pending = 1000
+	params := s.params()
+	params["wait-timeout"] = "0"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "timeout after 0s waiting for droplet 1 to be active")
+	c.Assert(s.do.requests[len(s.do.requests)-1], check.Equals, "DELETE /v2/droplets/1")
+	c.Assert(s.do.droplets, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineWithoutToken(c *check.C) {
+	s.provider.token = ""
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "DIGITALOCEAN_ACCESS_TOKEN is not set")
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.do.requests[len(s.do.requests)-1], check.Equals, "DELETE /v2/droplets/1")
+	c.Assert(s.do.droplets, check.HasLen, 0)
+	_, err = os.Stat(filepath.Dir(m.CaCert))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestDeleteMachineNotFound(c *check.C) {
+	err := s.provider.DeleteMachine(&iaas.Machine{Id: "10", CreationParams: s.params()})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	_, err = s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	s.do.nextID++
+	s.do.droplets[s.do.nextID] = &fakeDroplet{name: "other"}
+	params := map[string]string{"api-url": s.server.URL}
+	machines, err := s.provider.ListMachines(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 2)
+	c.Assert(machines[0].Id, check.Equals, "1")
+	c.Assert(machines[0].CreationParams, check.DeepEquals, params)
+	c.Assert(machines[1].Address, check.Equals, "104.0.0.1")
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	created, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	m, err := s.provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, &iaas.Machine{Id: "1", Iaas: "digitalocean", Status: "active", Address: "104.0.0.1", CreationParams: s.params()})
+}
+
+func (s *S) TestGetMachineNotFound(c *check.C) {
+	_, err := s.provider.GetMachine(&iaas.Machine{Id: "10", CreationParams: s.params()})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("digitalocean")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s)DigitalOcean IaaS optional params:.*")
+}
+
+func (s *S) TestCheckDocker(c *check.C) {
+	err := iaas.CheckDocker("digitalocean", nil)
+	c.Assert(err, check.IsNil)
+}
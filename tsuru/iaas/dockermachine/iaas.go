@@ -1,26 +1,421 @@
 package dockermachine
 
 import (
-	"os/exec"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/docker/machine/commands/mcndirs"
+	"github.com/docker/machine/drivers/none"
+	"github.com/docker/machine/drivers/virtualbox"
+	"github.com/docker/machine/libmachine"
+	"github.com/docker/machine/libmachine/drivers"
+	"github.com/docker/machine/libmachine/host"
+	"github.com/docker/machine/libmachine/mcnerror"
+	"github.com/docker/machine/libmachine/mcnflag"
+	"github.com/docker/machine/libmachine/persist"
+	"github.com/docker/machine/libmachine/state"
 )
 
+const defaultDriver = "virtualbox"
+
+// storePath is the directory where the machines are stored. It's the same
+// directory used by the docker-machine binary, so the machines created by
+// yati can also be managed with it.
+var storePath = mcndirs.GetBaseDir()
+
+// driverFactories are the drivers that run in-process.
+var driverFactories = map[string]func(name, storePath string) drivers.Driver{
+	"none": func(name, storePath string) drivers.Driver {
+		return none.NewDriver(name, storePath)
+	},
+	"virtualbox": func(name, storePath string) drivers.Driver {
+		return virtualbox.NewDriver(name, storePath)
+	},
+}
+
 func init() {
-	iaas.Register("docker-machine", &dmIaas{})
+	iaas.MustRegister("docker-machine", &dmIaas{})
 }
 
 type dmIaas struct{}
 
+// CreateMachine creates a machine with libmachine. The name and driver
+// params choose the machine name and the driver, every other param is a
+// flag of the driver, like virtualbox-memory. When no name is given, a
+// random one is generated, so several machines can be created with the same
+// params.
 func (i *dmIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
-	cmd := exec.Command("docker-machine", "create", "tsuru", "-d", "virtualbox")
-	err := cmd.Run()
+	name := params["name"]
+	if name == "" {
+		var err error
+		name, err = generateName()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !host.ValidateHostName(name) {
+		return nil, mcnerror.ErrInvalidHostname
+	}
+	driverName := params["driver"]
+	if driverName == "" {
+		driverName = defaultDriver
+	}
+	client := newClient()
+	exists, err := client.Exists(name)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, mcnerror.ErrHostAlreadyExists{Name: name}
+	}
+	driver, err := newDriver(driverName, name, client.Path)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := newDriverOptions(driver, params)
+	if err != nil {
+		return nil, err
+	}
+	err = driver.SetConfigFromFlags(opts)
+	if err != nil {
+		return nil, err
+	}
+	h, err := client.NewHost(driver)
+	if err != nil {
+		return nil, err
+	}
+	err = client.Create(h)
+	if err != nil {
+		removeHost(client, h)
+		return nil, err
+	}
+	m, err := machine(h)
 	if err != nil {
+		removeHost(client, h)
 		return nil, err
 	}
-	return &iaas.Machine{}, nil
+	m.CreationParams = params
+	return m, nil
 }
 
+// DeleteMachine removes the machine and its files from the store. Machines
+// that don't exist anymore are ignored.
 func (i *dmIaas) DeleteMachine(m *iaas.Machine) error {
+	if m.Id == "" {
+		return fmt.Errorf("unable to delete machine: missing id")
+	}
+	client := newClient()
+	h, err := client.Load(m.Id)
+	if err != nil {
+		if _, ok := err.(mcnerror.ErrHostDoesNotExist); ok {
+			return nil
+		}
+		return err
+	}
+	return removeHost(client, h)
+}
+
+// ListMachines returns the machines in the store. Machines using drivers
+// that don't run in-process are skipped.
+func (i *dmIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	client := newClient()
+	names, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	machines := []*iaas.Machine{}
+	for _, name := range names {
+		h, err := client.Load(name)
+		if _, ok := err.(errUnsupportedDriver); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m, err := machine(h)
+		if err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, nil
+}
+
+// GetMachine loads the machine from the store, refreshing its status and
+// address.
+func (i *dmIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	h, err := newClient().Load(m.Id)
+	if err != nil {
+		if _, ok := err.(mcnerror.ErrHostDoesNotExist); ok {
+			return nil, iaas.ErrMachineNotFound
+		}
+		return nil, err
+	}
+	current, err := machine(h)
+	if err != nil {
+		return nil, err
+	}
+	current.CreationParams = m.CreationParams
+	return current, nil
+}
+
+// Describe lists the drivers and the params each one accepts.
+func (i *dmIaas) Describe() string {
+	var buf bytes.Buffer
+	buf.WriteString(`docker-machine IaaS optional params:
+  name=<name>              Machine name, defaults to a random name
+  driver=<driver>          Driver used to create the machine, defaults to virtualbox
+`)
+	for _, name := range driverNames() {
+		fmt.Fprintf(&buf, "\n%s driver params:\n", name)
+		for _, f := range driverFactories[name]("", "").GetCreateFlags() {
+			fmt.Fprintf(&buf, "  %-40s %s\n", f.String()+"=<value>", flagUsage(f))
+		}
+	}
+	return buf.String()
+}
+
+// Flags returns the name and driver flags followed by the flags of every
+// driver. The defaults of the driver flags are only in their usage, since
+// each driver accepts only its own flags.
+func (i *dmIaas) Flags() []iaas.Flag {
+	flags := []iaas.Flag{
+		{Name: "name", Usage: "Machine name, defaults to a random name"},
+		{Name: "driver", Usage: "Driver used to create the machine", Value: defaultDriver, Values: driverNames()},
+	}
+	for _, name := range driverNames() {
+		for _, f := range driverFactories[name]("", "").GetCreateFlags() {
+			flag := iaas.Flag{Name: f.String(), Usage: flagUsage(f)}
+			switch f.(type) {
+			case mcnflag.IntFlag:
+				flag.Type = iaas.IntFlag
+			case mcnflag.BoolFlag:
+				flag.Type = iaas.BoolFlag
+			}
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func driverNames() []string {
+	var names []string
+	for name := range driverFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func flagUsage(f mcnflag.Flag) string {
+	switch f := f.(type) {
+	case mcnflag.StringFlag:
+		if f.Value != "" {
+			return fmt.Sprintf("%s, defaults to %s", f.Usage, f.Value)
+		}
+		return f.Usage
+	case mcnflag.StringSliceFlag:
+		return f.Usage
+	case mcnflag.IntFlag:
+		return fmt.Sprintf("%s, defaults to %d", f.Usage, f.Value)
+	case mcnflag.BoolFlag:
+		return f.Usage
+	}
+	return ""
+}
+
+func newClient() *libmachine.Client {
+	client := libmachine.NewClient(storePath)
+	certsDir := filepath.Join(storePath, "certs")
+	client.PluginStore = &persist.PluginStore{
+		Filestore:           persist.NewFilestore(storePath, certsDir, certsDir),
+		PluginDriverFactory: driverFactory{},
+	}
+	return client
+}
+
+// errUnsupportedDriver is returned when a driver doesn't run in-process.
+type errUnsupportedDriver struct {
+	name string
+}
+
+func (e errUnsupportedDriver) Error() string {
+	return fmt.Sprintf("driver %q is not supported, available drivers: %s", e.name, strings.Join(driverNames(), ", "))
+}
+
+func newDriver(driverName, name, storePath string) (drivers.Driver, error) {
+	factory, ok := driverFactories[driverName]
+	if !ok {
+		return nil, errUnsupportedDriver{name: driverName}
+	}
+	return factory(name, storePath), nil
+}
+
+// driverFactory loads the drivers of stored hosts in-process, instead of
+// running them as plugins.
+type driverFactory struct{}
+
+func (driverFactory) NewPluginDriver(driverName string, rawDriver []byte) (drivers.Driver, error) {
+	driver, err := newDriver(driverName, "", "")
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(rawDriver, driver)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s driver: %s", driverName, err)
+	}
+	return driver, nil
+}
+
+func removeHost(client *libmachine.Client, h *host.Host) error {
+	err := h.Driver.Remove()
+	if err != nil {
+		return err
+	}
+	return client.Remove(h.Name)
+}
+
+// machine returns the iaas machine of the host, with its status and the
+// certificates used to talk to its Docker daemon. The address is only known
+// while the host is running.
+func machine(h *host.Host) (*iaas.Machine, error) {
+	st, err := h.Driver.GetState()
+	if err != nil {
+		return nil, err
+	}
+	auth := h.HostOptions.AuthOptions
+	m := &iaas.Machine{
+		Id:         h.Name,
+		Iaas:       "docker-machine",
+		Status:     strings.ToLower(st.String()),
+		CaCert:     auth.CaCertPath,
+		ClientCert: auth.ClientCertPath,
+		ClientKey:  auth.ClientKeyPath,
+	}
+	if st != state.Running {
+		return m, nil
+	}
+	rawURL, err := h.URL()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	address, rawPort, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker url %q: %s", rawURL, err)
+	}
+	m.Port, err = strconv.Atoi(rawPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker url %q: %s", rawURL, err)
+	}
+	m.Address = address
+	return m, nil
+}
+
+// driverOptions gives the params to the driver, using the default values of
+// its flags for missing params.
+type driverOptions struct {
+	params map[string]string
+	flags  map[string]mcnflag.Flag
+}
+
+// newDriverOptions validates the params against the flags of the driver.
+func newDriverOptions(driver drivers.Driver, params map[string]string) (*driverOptions, error) {
+	opts := &driverOptions{params: params, flags: make(map[string]mcnflag.Flag)}
+	for _, f := range driver.GetCreateFlags() {
+		opts.flags[f.String()] = f
+	}
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "name" || k == "driver" {
+			continue
+		}
+		f, ok := opts.flags[k]
+		if !ok {
+			return nil, fmt.Errorf("unknown param %q for driver %q", k, driver.DriverName())
+		}
+		var err error
+		switch f.(type) {
+		case mcnflag.IntFlag:
+			_, err = strconv.Atoi(params[k])
+		case mcnflag.BoolFlag:
+			_, err = strconv.ParseBool(params[k])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for param %q", params[k], k)
+		}
+	}
+	return opts, nil
+}
+
+func (o *driverOptions) String(key string) string {
+	if v, ok := o.params[key]; ok {
+		return v
+	}
+	if v, ok := o.defaultValue(key).(string); ok {
+		return v
+	}
+	return ""
+}
+
+func (o *driverOptions) StringSlice(key string) []string {
+	if v, ok := o.params[key]; ok {
+		return strings.Split(v, ",")
+	}
+	if v, ok := o.defaultValue(key).([]string); ok {
+		return v
+	}
 	return nil
 }
+
+func (o *driverOptions) Int(key string) int {
+	if v, ok := o.params[key]; ok {
+		n, _ := strconv.Atoi(v)
+		return n
+	}
+	if v, ok := o.defaultValue(key).(int); ok {
+		return v
+	}
+	return 0
+}
+
+func (o *driverOptions) Bool(key string) bool {
+	if v, ok := o.params[key]; ok {
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func (o *driverOptions) defaultValue(key string) interface{} {
+	if f, ok := o.flags[key]; ok {
+		return f.Default()
+	}
+	return nil
+}
+
+func generateName() (string, error) {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "tsuru-" + hex.EncodeToString(b), nil
+}
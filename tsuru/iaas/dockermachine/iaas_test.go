@@ -0,0 +1,227 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dockermachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/docker/machine/drivers/virtualbox"
+	"github.com/docker/machine/libmachine/mcnerror"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	storePath string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpTest(c *check.C) {
+	s.storePath = storePath
+	storePath = c.MkDir()
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	storePath = s.storePath
+}
+
+func noneParams(name string) map[string]string {
+	return map[string]string{
+		"name":   name,
+		"driver": "none",
+		"url":    "tcp://10.0.0.1:2376",
+	}
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := noneParams("tsuru-1")
+	m, err := (&dmIaas{}).CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	certs := filepath.Join(storePath, "certs")
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             "tsuru-1",
+		Iaas:           "docker-machine",
+		Status:         "running",
+		Address:        "10.0.0.1",
+		Port:           2376,
+		CreationParams: params,
+		CaCert:         filepath.Join(certs, "ca.pem"),
+		ClientCert:     filepath.Join(certs, "cert.pem"),
+		ClientKey:      filepath.Join(certs, "key.pem"),
+	})
+	_, err = os.Stat(filepath.Join(storePath, "machines", "tsuru-1", "config.json"))
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(m.ClientCert)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestCreateMachineGeneratesName(c *check.C) {
+	params := noneParams("")
+	provider := &dmIaas{}
+	m1, err := provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	m2, err := provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.Id, check.Matches, "tsuru-[0-9a-f]{8}")
+	c.Assert(m2.Id, check.Not(check.Equals), m1.Id)
+}
+
+func (s *S) TestCreateMachineAlreadyExists(c *check.C) {
+	provider := &dmIaas{}
+	_, err := provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.IsNil)
+	_, err = provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.Equals, mcnerror.ErrHostAlreadyExists{Name: "tsuru-1"})
+}
+
+func (s *S) TestCreateMachineInvalidName(c *check.C) {
+	_, err := (&dmIaas{}).CreateMachine(noneParams("tsuru_1"))
+	c.Assert(err, check.Equals, mcnerror.ErrInvalidHostname)
+}
+
+func (s *S) TestCreateMachineUnknownDriver(c *check.C) {
+	_, err := (&dmIaas{}).CreateMachine(map[string]string{"driver": "amazonec2"})
+	c.Assert(err, check.ErrorMatches, `driver "amazonec2" is not supported, available drivers: none, virtualbox`)
+}
+
+func (s *S) TestCreateMachineInvalidParams(c *check.C) {
+	provider := &dmIaas{}
+	_, err := provider.CreateMachine(map[string]string{"virtualbox-memroy": "2048"})
+	c.Assert(err, check.ErrorMatches, `unknown param "virtualbox-memroy" for driver "virtualbox"`)
+	_, err = provider.CreateMachine(map[string]string{"virtualbox-memory": "2GB"})
+	c.Assert(err, check.ErrorMatches, `invalid value "2GB" for param "virtualbox-memory"`)
+}
+
+func (s *S) TestCreateMachineDriverConfigError(c *check.C) {
+	_, err := (&dmIaas{}).CreateMachine(map[string]string{"driver": "none"})
+	c.Assert(err, check.ErrorMatches, "--url option is required when no driver is selected")
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	provider := &dmIaas{}
+	m, err := provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.IsNil)
+	err = provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	exists, err := newClient().Exists("tsuru-1")
+	c.Assert(err, check.IsNil)
+	c.Assert(exists, check.Equals, false)
+}
+
+func (s *S) TestDeleteMachineNotFound(c *check.C) {
+	err := (&dmIaas{}).DeleteMachine(&iaas.Machine{Id: "tsuru-1"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDeleteMachineWithoutId(c *check.C) {
+	err := (&dmIaas{}).DeleteMachine(&iaas.Machine{})
+	c.Assert(err, check.ErrorMatches, "unable to delete machine: missing id")
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	provider := &dmIaas{}
+	machines, err := provider.ListMachines(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 0)
+	_, err = provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.IsNil)
+	_, err = provider.CreateMachine(noneParams("tsuru-2"))
+	c.Assert(err, check.IsNil)
+	machines, err = provider.ListMachines(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 2)
+	c.Assert(machines[0].Id, check.Equals, "tsuru-1")
+	c.Assert(machines[0].Address, check.Equals, "10.0.0.1")
+	c.Assert(machines[1].Id, check.Equals, "tsuru-2")
+}
+
+func (s *S) TestListMachinesSkipsUnsupportedDrivers(c *check.C) {
+	provider := &dmIaas{}
+	_, err := provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.IsNil)
+	_, err = provider.CreateMachine(noneParams("tsuru-2"))
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(storePath, "machines", "tsuru-2", "config.json")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	data = []byte(strings.Replace(string(data), `"DriverName": "none"`, `"DriverName": "amazonec2"`, 1))
+	err = ioutil.WriteFile(path, data, 0600)
+	c.Assert(err, check.IsNil)
+	machines, err := provider.ListMachines(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 1)
+	c.Assert(machines[0].Id, check.Equals, "tsuru-1")
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	provider := &dmIaas{}
+	created, err := provider.CreateMachine(noneParams("tsuru-1"))
+	c.Assert(err, check.IsNil)
+	m, err := provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, created)
+}
+
+func (s *S) TestGetMachineNotFound(c *check.C) {
+	_, err := (&dmIaas{}).GetMachine(&iaas.Machine{Id: "tsuru-1"})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc := (&dmIaas{}).Describe()
+	c.Assert(desc, check.Matches, `(?s)docker-machine IaaS optional params:\n  name=<name> .*`)
+	c.Assert(desc, check.Matches, `(?s).*\nnone driver params:\n  url=<value> +URL of host when no driver is selected\n.*`)
+	c.Assert(desc, check.Matches, `(?s).*\n  virtualbox-memory=<value> +Size of memory for host in MB, defaults to 1024\n.*`)
+}
+
+func (s *S) TestFlags(c *check.C) {
+	flags := (&dmIaas{}).Flags()
+	c.Assert(flags[0].Name, check.Equals, "name")
+	c.Assert(flags[1], check.DeepEquals, iaas.Flag{Name: "driver", Usage: "Driver used to create the machine", Value: "virtualbox", Values: []string{"none", "virtualbox"}})
+	byName := make(map[string]iaas.Flag)
+	for _, f := range flags {
+		byName[f.Name] = f
+	}
+	c.Assert(byName["url"], check.DeepEquals, iaas.Flag{Name: "url", Usage: "URL of host when no driver is selected"})
+	c.Assert(byName["virtualbox-memory"], check.DeepEquals, iaas.Flag{Name: "virtualbox-memory", Usage: "Size of memory for host in MB, defaults to 1024", Type: iaas.IntFlag})
+	c.Assert(byName["virtualbox-no-share"].Type, check.Equals, iaas.BoolFlag)
+}
+
+func (s *S) TestValidateParams(c *check.C) {
+	params, err := iaas.ValidateParams("docker-machine", map[string]string{"driver": "none", "url": "tcp://10.0.0.1:2376"})
+	c.Assert(err, check.IsNil)
+	c.Assert(params, check.DeepEquals, map[string]string{"driver": "none", "url": "tcp://10.0.0.1:2376"})
+	params, err = iaas.ValidateParams("docker-machine", map[string]string{})
+	c.Assert(err, check.IsNil)
+	c.Assert(params, check.DeepEquals, map[string]string{"driver": "virtualbox"})
+	_, err = iaas.ValidateParams("docker-machine", map[string]string{"driver": "vmware", "virtualbox-memory": "lots"})
+	c.Assert(err, check.ErrorMatches, `invalid params for iaas "docker-machine":
+  invalid value "vmware" for param "driver", it must be one of none, virtualbox
+  invalid value "lots" for param "virtualbox-memory", it must be an integer`)
+}
+
+func (s *S) TestDriverOptions(c *check.C) {
+	driver := virtualbox.NewDriver("tsuru-1", storePath)
+	opts, err := newDriverOptions(driver, map[string]string{
+		"virtualbox-cpu-count":       "2",
+		"virtualbox-no-share":        "true",
+		"virtualbox-boot2docker-url": "http://example.com/b2d.iso",
+	})
+	c.Assert(err, check.IsNil)
+	c.Assert(opts.Int("virtualbox-cpu-count"), check.Equals, 2)
+	c.Assert(opts.Int("virtualbox-memory"), check.Equals, 1024)
+	c.Assert(opts.Bool("virtualbox-no-share"), check.Equals, true)
+	c.Assert(opts.Bool("virtualbox-dns-proxy"), check.Equals, false)
+	c.Assert(opts.String("virtualbox-boot2docker-url"), check.Equals, "http://example.com/b2d.iso")
+	c.Assert(opts.String("virtualbox-hostonly-cidr"), check.Equals, "192.168.99.1/24")
+	c.Assert(opts.String("swarm-host"), check.Equals, "")
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dockertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Certs are the certificates of a Docker daemon listening with TLS, in PEM:
+// a CA, the certificate of the daemon and the one of the client, both signed
+// by the CA.
+type Certs struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// GenerateCerts returns new certificates for the Docker daemon in the given
+// address, valid for ten years. The address is either an IP or a name, like
+// ServerName. The key of the CA isn't kept, so no other certificate can be
+// signed by it.
+func GenerateCerts(address string) (*Certs, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := certTemplate("yati")
+	if err != nil {
+		return nil, err
+	}
+	ca.IsCA = true
+	ca.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	server, err := certTemplate(address)
+	if err != nil {
+		return nil, err
+	}
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if ip := net.ParseIP(address); ip != nil {
+		server.IPAddresses = []net.IP{ip}
+	} else {
+		server.DNSNames = []string{address}
+	}
+	serverCert, serverKey, err := signCert(server, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	client, err := certTemplate("yati")
+	if err != nil {
+		return nil, err
+	}
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	clientCert, clientKey, err := signCert(client, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Certs{
+		CA:         string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+		ServerCert: serverCert,
+		ServerKey:  serverKey,
+		ClientCert: clientCert,
+		ClientKey:  clientKey,
+	}, nil
+}
+
+func certTemplate(name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"yati"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+// signCert creates a key and the certificate of the template signed by the
+// CA, returning both in PEM.
+func signCert(template, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return "", "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return string(cert), string(keyPEM), nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dockertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+
+	"gopkg.in/check.v1"
+)
+
+func parseCert(c *check.C, data string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(data))
+	c.Assert(block, check.NotNil)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, check.IsNil)
+	return cert
+}
+
+func (s *S) TestGenerateCerts(c *check.C) {
+	certs, err := GenerateCerts("10.0.0.1")
+	c.Assert(err, check.IsNil)
+	roots := x509.NewCertPool()
+	c.Assert(roots.AppendCertsFromPEM([]byte(certs.CA)), check.Equals, true)
+	server := parseCert(c, certs.ServerCert)
+	_, err = server.Verify(x509.VerifyOptions{
+		DNSName:   "10.0.0.1",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	c.Assert(err, check.IsNil)
+	client := parseCert(c, certs.ClientCert)
+	_, err = client.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	c.Assert(err, check.IsNil)
+	_, err = tls.X509KeyPair([]byte(certs.ServerCert), []byte(certs.ServerKey))
+	c.Assert(err, check.IsNil)
+	_, err = tls.X509KeyPair([]byte(certs.ClientCert), []byte(certs.ClientKey))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestGenerateCertsHostname(c *check.C) {
+	certs, err := GenerateCerts("docker.example.com")
+	c.Assert(err, check.IsNil)
+	server := parseCert(c, certs.ServerCert)
+	c.Assert(server.DNSNames, check.DeepEquals, []string{"docker.example.com"})
+	c.Assert(server.IPAddresses, check.HasLen, 0)
+}
@@ -0,0 +1,179 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dockertls installs Docker in the machines of the providers, making
+// it listen with TLS, and keeps the client certificates used to reach it.
+package dockertls
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+const (
+	// Port is the port Docker listens on with TLS.
+	Port = 2376
+
+	// ServerName is the name in the certificate of the daemons set up
+	// when the machine boots, since their address isn't known when the
+	// certificate is generated. Clients check it instead of the address.
+	ServerName = "docker.yati"
+
+	// ExistingDocker is printed by the install script when Docker was
+	// already installed by someone else.
+	ExistingDocker = "yati: docker already installed"
+)
+
+// pollInterval is the time between pings of a Docker daemon that isn't
+// ready yet.
+var pollInterval = 5 * time.Second
+
+// installScript installs Docker when it's missing and makes it listen on
+// the given port with TLS, trusting only the certificates signed by the given
+// CA. The marker file tells that Docker was installed by yati, so it's
+// configured again on the next install and removed on uninstall. Docker
+// installations without the marker are left alone.
+const installScript = `set -e
+if [ ! -f /var/lib/yati/docker-installed ] && command -v docker >/dev/null 2>&1; then
+  echo "%[1]s"
+  exit 0
+fi
+if ! command -v docker >/dev/null 2>&1; then
+  curl -fsSL https://get.docker.com | sh
+  mkdir -p /var/lib/yati
+  touch /var/lib/yati/docker-installed
+fi
+mkdir -p /etc/docker/yati
+cat > /etc/docker/yati/ca.pem <<'EOF'
+%[3]sEOF
+cat > /etc/docker/yati/server.pem <<'EOF'
+%[4]sEOF
+(umask 077 && cat > /etc/docker/yati/server-key.pem <<'EOF'
+%[5]sEOF
+)
+mkdir -p /etc/systemd/system/docker.service.d
+cat > /etc/systemd/system/docker.service.d/yati.conf <<EOF
+[Service]
+ExecStart=
+ExecStart=/usr/bin/dockerd -H unix:///var/run/docker.sock -H tcp://0.0.0.0:%[2]d --tlsverify --tlscacert=/etc/docker/yati/ca.pem --tlscert=/etc/docker/yati/server.pem --tlskey=/etc/docker/yati/server-key.pem
+EOF
+systemctl daemon-reload
+systemctl restart docker
+`
+
+// InstallScript returns the shell script that installs Docker with the
+// server certificates, listening on the given port. It prints
+// ExistingDocker and changes nothing when Docker was installed by someone
+// else.
+func InstallScript(port int, certs *Certs) string {
+	return fmt.Sprintf(installScript, ExistingDocker, port, certs.CA, certs.ServerCert, certs.ServerKey)
+}
+
+// UserData returns the user data that runs the install script, listening on
+// Port, when the machine boots. The user data given by the user, either a
+// script or a cloud-config, is kept along with it in a MIME multipart
+// archive, which cloud-init runs in order.
+func UserData(certs *Certs, userData string) (string, error) {
+	script := "#!/bin/sh\n" + InstallScript(Port, certs)
+	if userData == "" {
+		return script, nil
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	userType := "text/x-shellscript"
+	if strings.HasPrefix(userData, "#cloud-config") {
+		userType = "text/cloud-config"
+	}
+	parts := []struct{ contentType, content string }{
+		{"text/x-shellscript", script},
+		{userType, userData},
+	}
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.contentType+`; charset="utf-8"`)
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		_, err = pw.Write([]byte(p.content))
+		if err != nil {
+			return "", err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n%s", w.Boundary(), body.String()), nil
+}
+
+// CertsDir is the directory where the client certificates of the Docker
+// daemon of the named machine of the iaas are kept.
+func CertsDir(iaasName, name string) string {
+	return cmd.JoinWithUserDir(".yati", iaasName, name)
+}
+
+// Save writes the client certificates to dir and sets them in the machine,
+// along with the port of the daemon.
+func Save(dir string, certs *Certs, port int, m *iaas.Machine) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	files := map[string]string{"ca.pem": certs.CA, "cert.pem": certs.ClientCert, "key.pem": certs.ClientKey}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	m.Port = port
+	m.CaCert = filepath.Join(dir, "ca.pem")
+	m.ClientCert = filepath.Join(dir, "cert.pem")
+	m.ClientKey = filepath.Join(dir, "key.pem")
+	return nil
+}
+
+// Client returns a client to the Docker daemon of the machine, using the
+// client certificates in it.
+func Client(m *iaas.Machine) (*docker.Client, error) {
+	client, err := docker.NewTLSClient(fmt.Sprintf("https://%s:%d", m.Address, m.Port), m.ClientCert, m.ClientKey, m.CaCert)
+	if err != nil {
+		return nil, err
+	}
+	client.TLSConfig.ServerName = m.TLSServerName
+	return client, nil
+}
+
+// Wait pings the Docker daemon of the machine until it answers. Docker is
+// installed when the machine boots, which takes a while after the machine
+// is running.
+func Wait(m *iaas.Machine, timeout time.Duration) error {
+	client, err := Client(m)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = client.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout after %s waiting for Docker in %s: %s", timeout, m.Address, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
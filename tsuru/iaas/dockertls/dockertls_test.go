@@ -0,0 +1,182 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dockertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	home string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	pollInterval = time.Millisecond
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+}
+
+func (s *S) TestInstallScript(c *check.C) {
+	certs, err := GenerateCerts("10.0.0.1")
+	c.Assert(err, check.IsNil)
+	script := InstallScript(2377, certs)
+	c.Assert(script, check.Matches, "(?s)set -e\n.*echo \"yati: docker already installed\".*get.docker.com.*tcp://0.0.0.0:2377 --tlsverify .*")
+	c.Assert(strings.Contains(script, certs.CA), check.Equals, true)
+	c.Assert(strings.Contains(script, certs.ServerKey), check.Equals, true)
+	c.Assert(strings.Contains(script, certs.ClientKey), check.Equals, false)
+}
+
+func (s *S) TestUserData(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	data, err := UserData(certs, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.Equals, "#!/bin/sh\n"+InstallScript(Port, certs))
+}
+
+func (s *S) TestUserDataWithUserData(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	data, err := UserData(certs, "#cloud-config\npackages: [htop]\n")
+	c.Assert(err, check.IsNil)
+	header := strings.SplitN(data, "\n", 2)[0]
+	mediaType, params, err := mime.ParseMediaType(strings.TrimPrefix(header, "Content-Type: "))
+	c.Assert(err, check.IsNil)
+	c.Assert(mediaType, check.Equals, "multipart/mixed")
+	body := strings.SplitN(data, "\n\n", 2)[1]
+	r := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	var types, contents []string
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(part)
+		c.Assert(err, check.IsNil)
+		types = append(types, part.Header.Get("Content-Type"))
+		contents = append(contents, string(content))
+	}
+	c.Assert(types, check.DeepEquals, []string{`text/x-shellscript; charset="utf-8"`, `text/cloud-config; charset="utf-8"`})
+	c.Assert(contents, check.DeepEquals, []string{"#!/bin/sh\n" + InstallScript(Port, certs), "#cloud-config\npackages: [htop]\n"})
+}
+
+func (s *S) TestUserDataWithScript(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	data, err := UserData(certs, "#!/bin/sh\necho hi\n")
+	c.Assert(err, check.IsNil)
+	c.Assert(data, check.Matches, `(?s).*Content-Type: text/x-shellscript; charset="utf-8"\r\n\r\n#!/bin/sh\necho hi\n.*`)
+}
+
+func (s *S) TestCertsDir(c *check.C) {
+	c.Assert(CertsDir("ec2", "i-1"), check.Equals, filepath.Join(os.Getenv("HOME"), ".yati", "ec2", "i-1"))
+}
+
+func (s *S) TestSave(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	dir := CertsDir("ec2", "i-1")
+	m := &iaas.Machine{Id: "i-1"}
+	err = Save(dir, certs, Port, m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Port, check.Equals, Port)
+	c.Assert(m.CaCert, check.Equals, filepath.Join(dir, "ca.pem"))
+	c.Assert(m.ClientCert, check.Equals, filepath.Join(dir, "cert.pem"))
+	c.Assert(m.ClientKey, check.Equals, filepath.Join(dir, "key.pem"))
+	key, err := ioutil.ReadFile(m.ClientKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(key), check.Equals, certs.ClientKey)
+	info, err := os.Stat(m.ClientKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+}
+
+// startDocker starts a fake Docker daemon answering pings with TLS, using
+// the server certificates and requiring a client certificate signed by the
+// CA.
+func startDocker(c *check.C, certs *Certs) *httptest.Server {
+	cert, err := tls.X509KeyPair([]byte(certs.ServerCert), []byte(certs.ServerKey))
+	c.Assert(err, check.IsNil)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(certs.CA))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	server.StartTLS()
+	return server
+}
+
+func (s *S) machine(c *check.C, certs *Certs, server *httptest.Server) *iaas.Machine {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	c.Assert(err, check.IsNil)
+	m := &iaas.Machine{Id: "i-1", Address: host, TLSServerName: ServerName}
+	err = Save(CertsDir("ec2", "i-1"), certs, 0, m)
+	c.Assert(err, check.IsNil)
+	m.Port, _ = strconv.Atoi(port)
+	return m
+}
+
+func (s *S) TestWait(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	server := startDocker(c, certs)
+	defer server.Close()
+	m := s.machine(c, certs, server)
+	err = Wait(m, time.Second)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestWaitChecksServerName(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	server := startDocker(c, certs)
+	defer server.Close()
+	m := s.machine(c, certs, server)
+	m.TLSServerName = ""
+	err = Wait(m, 10*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, `timeout after 10ms waiting for Docker in 127.0.0.1: .*certificate.*`)
+}
+
+func (s *S) TestWaitTimeout(c *check.C) {
+	certs, err := GenerateCerts(ServerName)
+	c.Assert(err, check.IsNil)
+	server := startDocker(c, certs)
+	m := s.machine(c, certs, server)
+	server.Close()
+	err = Wait(m, 10*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, `timeout after 10ms waiting for Docker in 127.0.0.1: .*`)
+}
@@ -0,0 +1,293 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ec2
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/dockertls"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	defaultRegion      = "us-east-1"
+	defaultWaitTimeout = 300
+	// yatiTag is the tag added to the instances created by yati, so they
+	// can be listed.
+	yatiTag = "yati"
+)
+
+// pollInterval is the time between checks of the instance state.
+var pollInterval = 5 * time.Second
+
+// waitDocker waits for the Docker daemon installed when the instance boots.
+var waitDocker = dockertls.Wait
+
+func init() {
+	iaas.MustRegister("ec2", &ec2Iaas{})
+}
+
+// ec2Iaas creates instances in Amazon EC2. The credentials are read from
+// the environment or from ~/.aws/credentials unless creds is set. The region
+// and endpoint are the ones in the params.
+type ec2Iaas struct {
+	creds *credentials.Credentials
+}
+
+func (i *ec2Iaas) Describe() string {
+	return fmt.Sprintf(`EC2 IaaS required params:
+  image=<image id>             Image AMI ID
+  type=<instance type>         Instance type, like t2.medium
+
+Optional params:
+  region=<region>              Chosen region, defaults to %s
+  key-name=<key name>          Key pair name for the instance
+  subnet=<subnet id>           Subnet the instance is launched in
+  security-group=<group>       Security group name, or id when it starts with sg-
+  wait-timeout=<seconds>       Time to wait for the instance and its Docker, defaults to %d
+  endpoint=<url>               EC2 endpoint, overrides the region
+
+The credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or
+from ~/.aws/credentials. Docker is installed with TLS when the instance
+boots, listening on the port %d, which must be open in the security group.
+`, defaultRegion, defaultWaitTimeout, dockertls.Port)
+}
+
+func (i *ec2Iaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "image", Usage: "Image AMI ID", Required: true},
+		{Name: "type", Usage: "Instance type, like t2.medium", Required: true},
+		{Name: "region", Usage: "Chosen region", Value: defaultRegion},
+		{Name: "key-name", Usage: "Key pair name for the instance"},
+		{Name: "subnet", Usage: "Subnet the instance is launched in"},
+		{Name: "security-group", Usage: "Security group name, or id when it starts with sg-"},
+		{Name: "wait-timeout", Usage: "Time to wait for the instance and its Docker, in seconds", Type: iaas.IntFlag, Value: strconv.Itoa(defaultWaitTimeout)},
+		{Name: "endpoint", Usage: "EC2 endpoint, overrides the region"},
+	}
+}
+
+func (i *ec2Iaas) client(params map[string]string) *ec2.EC2 {
+	region, endpoint := params["region"], params["endpoint"]
+	if region == "" {
+		region = defaultRegion
+	}
+	config := &aws.Config{Region: aws.String(region)}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	if i.creds != nil {
+		config.Credentials = i.creds
+	}
+	return ec2.New(session.New(config))
+}
+
+// buildRunInstancesInput returns the options used to run the instance
+// described by params.
+func buildRunInstancesInput(params map[string]string) (*ec2.RunInstancesInput, error) {
+	for _, name := range []string{"image", "type"} {
+		if params[name] == "" {
+			return nil, fmt.Errorf("the parameter %q is required", name)
+		}
+	}
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(params["image"]),
+		InstanceType: aws.String(params["type"]),
+		MinCount:     aws.Int64(1),
+		MaxCount:     aws.Int64(1),
+	}
+	if v := params["key-name"]; v != "" {
+		input.KeyName = aws.String(v)
+	}
+	if v := params["subnet"]; v != "" {
+		input.SubnetId = aws.String(v)
+	}
+	if v := params["security-group"]; v != "" {
+		if strings.HasPrefix(v, "sg-") {
+			input.SecurityGroupIds = []*string{aws.String(v)}
+		} else {
+			input.SecurityGroups = []*string{aws.String(v)}
+		}
+	}
+	return input, nil
+}
+
+// CreateMachine runs an instance and waits for it to be running. Docker is
+// installed with TLS by the user data of the instance, and the machine is
+// only returned when it answers. Its client certificates are kept in
+// ~/.yati/ec2/<instance id>.
+func (i *ec2Iaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	input, err := buildRunInstancesInput(params)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := iaas.IntParam(params, "wait-timeout", defaultWaitTimeout)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := dockertls.GenerateCerts(dockertls.ServerName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate Docker certificates: %s", err)
+	}
+	userData, err := dockertls.UserData(certs, "")
+	if err != nil {
+		return nil, err
+	}
+	input.UserData = aws.String(base64.StdEncoding.EncodeToString([]byte(userData)))
+	client := i.client(params)
+	reservation, err := client.RunInstances(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(reservation.Instances) == 0 {
+		return nil, fmt.Errorf("no instance created")
+	}
+	id := aws.StringValue(reservation.Instances[0].InstanceId)
+	_, err = client.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(yatiTag), Value: aws.String("true")}},
+	})
+	var instance *ec2.Instance
+	if err == nil {
+		instance, err = waitRunning(client, id, time.Duration(timeout)*time.Second)
+	}
+	if err == nil {
+		m := machine(instance)
+		m.CreationParams = params
+		m.TLSServerName = dockertls.ServerName
+		err = dockertls.Save(dockertls.CertsDir("ec2", id), certs, dockertls.Port, m)
+		if err == nil {
+			err = waitDocker(m, time.Duration(timeout)*time.Second)
+		}
+		if err == nil {
+			return m, nil
+		}
+	}
+	client.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(id)}})
+	os.RemoveAll(dockertls.CertsDir("ec2", id))
+	return nil, err
+}
+
+// DeleteMachine terminates the instance and removes its client
+// certificates.
+func (i *ec2Iaas) DeleteMachine(m *iaas.Machine) error {
+	client := i.client(m.CreationParams)
+	_, err := client.TerminateInstances(&ec2.TerminateInstancesInput{InstanceIds: []*string{aws.String(m.Id)}})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return os.RemoveAll(dockertls.CertsDir("ec2", m.Id))
+}
+
+// ListMachines returns the instances created by yati in the region of the
+// params that weren't terminated.
+func (i *ec2Iaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	resp, err := i.client(params).DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(yatiTag)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running", "stopping", "stopped"})},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	machines := []*iaas.Machine{}
+	for _, r := range resp.Reservations {
+		for _, instance := range r.Instances {
+			m := machine(instance)
+			m.CreationParams = params
+			machines = append(machines, m)
+		}
+	}
+	return machines, nil
+}
+
+// GetMachine describes the instance in the region it was created in.
+func (i *ec2Iaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	instance, err := describeInstance(i.client(m.CreationParams), m.Id)
+	if err != nil {
+		return nil, err
+	}
+	current := machine(instance)
+	current.CreationParams = m.CreationParams
+	return current, nil
+}
+
+func describeInstance(client *ec2.EC2, id string) (*ec2.Instance, error) {
+	resp, err := client.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(id)}})
+	if isNotFound(err) {
+		return nil, iaas.ErrMachineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil, iaas.ErrMachineNotFound
+	}
+	return resp.Reservations[0].Instances[0], nil
+}
+
+// waitRunning polls the instance until it's running.
+func waitRunning(client *ec2.EC2, id string, timeout time.Duration) (*ec2.Instance, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		instance, err := describeInstance(client, id)
+		if err != nil && err != iaas.ErrMachineNotFound {
+			return nil, err
+		}
+		if instance != nil {
+			switch stateName(instance) {
+			case ec2.InstanceStateNameRunning:
+				return instance, nil
+			case ec2.InstanceStateNameShuttingDown, ec2.InstanceStateNameTerminated:
+				var reason string
+				if instance.StateReason != nil {
+					reason = aws.StringValue(instance.StateReason.Message)
+				}
+				return nil, fmt.Errorf("instance %s was terminated: %s", id, reason)
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timeout after %s waiting for instance %s to run", timeout, id)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// machine returns the iaas machine of the instance. Instances without a
+// public address use their private address.
+func machine(instance *ec2.Instance) *iaas.Machine {
+	address := aws.StringValue(instance.PublicIpAddress)
+	if address == "" {
+		address = aws.StringValue(instance.PrivateIpAddress)
+	}
+	return &iaas.Machine{
+		Id:      aws.StringValue(instance.InstanceId),
+		Iaas:    "ec2",
+		Status:  stateName(instance),
+		Address: address,
+	}
+}
+
+func stateName(instance *ec2.Instance) string {
+	if instance.State == nil {
+		return ""
+	}
+	return aws.StringValue(instance.State.Name)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(awserr.Error)
+	return ok && e.Code() == "InvalidInstanceID.NotFound"
+}
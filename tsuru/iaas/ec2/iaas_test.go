@@ -0,0 +1,319 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ec2
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	home     string
+	server   *httptest.Server
+	ec2      *fakeEC2
+	provider *ec2Iaas
+	// waited are the machines whose Docker was waited for.
+	waited []*iaas.Machine
+	// dockerErr is returned by waitDocker.
+	dockerErr error
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	pollInterval = time.Millisecond
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	s.waited = nil
+	s.dockerErr = nil
+	waitDocker = func(m *iaas.Machine, timeout time.Duration) error {
+		s.waited = append(s.waited, m)
+		return s.dockerErr
+	}
+	s.ec2 = &fakeEC2{states: make(map[string][]string), pending: 1}
+	s.server = httptest.NewServer(s.ec2)
+	s.provider = &ec2Iaas{creds: credentials.NewStaticCredentials("key-id", "secret", "")}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.Close()
+}
+
+func (s *S) params() map[string]string {
+	return map[string]string{
+		"endpoint":       s.server.URL,
+		"image":          "ami-123",
+		"type":           "t2.medium",
+		"key-name":       "tsuru",
+		"subnet":         "subnet-1",
+		"security-group": "sg-1",
+	}
+}
+
+// fakeEC2 is a stand-in for the EC2 query API. Instances stay pending for
+// the given number of DescribeInstances calls before running.
+type fakeEC2 struct {
+	mu       sync.Mutex
+	requests []url.Values
+	// regions are the regions the requests were signed for.
+	regions []string
+	states  map[string][]string
+	ids     []string
+	pending int
+	fail    string
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.ParseForm()
+	f.requests = append(f.requests, r.Form)
+	f.regions = append(f.regions, signedRegion(r))
+	action := r.Form.Get("Action")
+	if action == f.fail {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidParameterValue</Code><Message>invalid value</Message></Error></Errors><RequestID>1</RequestID></Response>`)
+		return
+	}
+	switch action {
+	case "RunInstances":
+		id := fmt.Sprintf("i-%d", len(f.ids)+1)
+		f.ids = append(f.ids, id)
+		for j := 0; j < f.pending; j++ {
+			f.states[id] = append(f.states[id], "pending")
+		}
+		f.states[id] = append(f.states[id], "running")
+		fmt.Fprintf(w, `<RunInstancesResponse><reservationId>r-1</reservationId><instancesSet><item><instanceId>%s</instanceId><instanceState><code>0</code><name>pending</name></instanceState></item></instancesSet></RunInstancesResponse>`, id)
+	case "CreateTags":
+		fmt.Fprint(w, `<CreateTagsResponse><return>true</return></CreateTagsResponse>`)
+	case "DescribeInstances":
+		ids := f.ids
+		if id := r.Form.Get("InstanceId.1"); id != "" {
+			if _, ok := f.states[id]; !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>The instance ID '%s' does not exist</Message></Error></Errors><RequestID>1</RequestID></Response>`, id)
+				return
+			}
+			ids = []string{id}
+		}
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet>`)
+		for _, id := range ids {
+			states := f.states[id]
+			state := states[0]
+			if len(states) > 1 {
+				f.states[id] = states[1:]
+			}
+			if state == "terminated" && r.Form.Get("InstanceId.1") == "" {
+				continue
+			}
+			fmt.Fprintf(w, `<item><reservationId>r-1</reservationId><instancesSet><item><instanceId>%s</instanceId><instanceState><name>%s</name></instanceState>`, id, state)
+			if state == "running" {
+				fmt.Fprint(w, `<privateIpAddress>10.0.0.1</privateIpAddress><ipAddress>54.0.0.1</ipAddress>`)
+			}
+			fmt.Fprint(w, `</item></instancesSet></item>`)
+		}
+		fmt.Fprint(w, `</reservationSet></DescribeInstancesResponse>`)
+	case "TerminateInstances":
+		id := r.Form.Get("InstanceId.1")
+		if _, ok := f.states[id]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>not found</Message></Error></Errors><RequestID>1</RequestID></Response>`)
+			return
+		}
+		f.states[id] = []string{"terminated"}
+		fmt.Fprintf(w, `<TerminateInstancesResponse><instancesSet><item><instanceId>%s</instanceId><currentState><name>shutting-down</name></currentState></item></instancesSet></TerminateInstancesResponse>`, id)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (f *fakeEC2) actions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var actions []string
+	for _, r := range f.requests {
+		actions = append(actions, r.Get("Action"))
+	}
+	return actions
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := s.params()
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	dir := filepath.Join(os.Getenv("HOME"), ".yati", "ec2", "i-1")
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             "i-1",
+		Iaas:           "ec2",
+		Status:         "running",
+		Address:        "54.0.0.1",
+		Port:           2376,
+		CreationParams: params,
+		CaCert:         filepath.Join(dir, "ca.pem"),
+		ClientCert:     filepath.Join(dir, "cert.pem"),
+		ClientKey:      filepath.Join(dir, "key.pem"),
+		TLSServerName:  "docker.yati",
+	})
+	c.Assert(s.waited, check.DeepEquals, []*iaas.Machine{m})
+	c.Assert(s.ec2.actions(), check.DeepEquals, []string{"RunInstances", "CreateTags", "DescribeInstances", "DescribeInstances"})
+	run := s.ec2.requests[0]
+	c.Assert(run.Get("ImageId"), check.Equals, "ami-123")
+	c.Assert(run.Get("InstanceType"), check.Equals, "t2.medium")
+	c.Assert(run.Get("KeyName"), check.Equals, "tsuru")
+	c.Assert(run.Get("SubnetId"), check.Equals, "subnet-1")
+	c.Assert(run.Get("SecurityGroupId.1"), check.Equals, "sg-1")
+	c.Assert(run.Get("MinCount"), check.Equals, "1")
+	c.Assert(run.Get("MaxCount"), check.Equals, "1")
+	userData, err := base64.StdEncoding.DecodeString(run.Get("UserData"))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(userData), check.Matches, "(?s)#!/bin/sh\nset -e\n.*get.docker.com.*tcp://0.0.0.0:2376 --tlsverify .*")
+	ca, err := ioutil.ReadFile(m.CaCert)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(string(userData), string(ca)), check.Equals, true)
+	tags := s.ec2.requests[1]
+	c.Assert(tags.Get("ResourceId.1"), check.Equals, "i-1")
+	c.Assert(tags.Get("Tag.1.Key"), check.Equals, "yati")
+}
+
+func (s *S) TestCreateMachineSecurityGroupName(c *check.C) {
+	params := s.params()
+	params["security-group"] = "tsuru"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.ec2.requests[0].Get("SecurityGroup.1"), check.Equals, "tsuru")
+}
+
+func (s *S) TestCreateMachineRequiredParams(c *check.C) {
+	params := s.params()
+	delete(params, "image")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, `the parameter "image" is required`)
+	c.Assert(s.ec2.actions(), check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineRunError(c *check.C) {
+	s.ec2.fail = "RunInstances"
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "(?s)InvalidParameterValue: invalid value.*")
+}
+
+func (s *S) TestCreateMachineTimeout(c *check.C) {
+	s.ec2.pending = 1000
+	params := s.params()
+	params["wait-timeout"] = "0"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "timeout after 0s waiting for instance i-1 to run")
+	actions := s.ec2.actions()
+	c.Assert(actions[len(actions)-1], check.Equals, "TerminateInstances")
+}
+
+func (s *S) TestCreateMachineDockerTimeout(c *check.C) {
+	s.dockerErr = errors.New("timeout waiting for Docker")
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.ErrorMatches, "timeout waiting for Docker")
+	actions := s.ec2.actions()
+	c.Assert(actions[len(actions)-1], check.Equals, "TerminateInstances")
+	_, err = os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "ec2", "i-1"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	actions := s.ec2.actions()
+	c.Assert(actions[len(actions)-1], check.Equals, "TerminateInstances")
+	c.Assert(s.ec2.states["i-1"], check.DeepEquals, []string{"terminated"})
+	_, err = os.Stat(filepath.Dir(m.CaCert))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestDeleteMachineNotFound(c *check.C) {
+	err := s.provider.DeleteMachine(&iaas.Machine{Id: "i-10", CreationParams: s.params()})
+	c.Assert(err, check.IsNil)
+}
+
+// signedRegion returns the region in the credential scope of the signature,
+// like key-id/20160101/us-east-1/ec2/aws4_request.
+func signedRegion(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	start := strings.Index(auth, "Credential=")
+	if start < 0 {
+		return ""
+	}
+	scope := strings.Split(strings.SplitN(auth[start:], ",", 2)[0], "/")
+	if len(scope) < 3 {
+		return ""
+	}
+	return scope[2]
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	_, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	params := map[string]string{"endpoint": s.server.URL, "region": "eu-west-1"}
+	machines, err := s.provider.ListMachines(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 1)
+	c.Assert(machines[0].Id, check.Equals, "i-1")
+	c.Assert(machines[0].CreationParams, check.DeepEquals, params)
+	list := s.ec2.requests[len(s.ec2.requests)-1]
+	c.Assert(list.Get("Filter.1.Name"), check.Equals, "tag-key")
+	c.Assert(list.Get("Filter.1.Value.1"), check.Equals, "yati")
+	c.Assert(s.ec2.regions[len(s.ec2.regions)-1], check.Equals, "eu-west-1")
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	params := s.params()
+	params["region"] = "eu-west-1"
+	created, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	m, err := s.provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, &iaas.Machine{Id: "i-1", Iaas: "ec2", Status: "running", Address: "54.0.0.1", CreationParams: params})
+	c.Assert(s.ec2.regions[len(s.ec2.regions)-1], check.Equals, "eu-west-1")
+}
+
+func (s *S) TestGetMachineNotFound(c *check.C) {
+	_, err := s.provider.GetMachine(&iaas.Machine{Id: "i-10", CreationParams: s.params()})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("ec2")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s)EC2 IaaS required params:.*")
+}
+
+func (s *S) TestCheckDocker(c *check.C) {
+	err := iaas.CheckDocker("ec2", map[string]string{"image": "ami-123456", "type": "t2.medium"})
+	c.Assert(err, check.IsNil)
+}
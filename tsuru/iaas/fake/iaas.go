@@ -1,19 +1,209 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fake provides an in-memory iaas for tests. Its machines have
+// deterministic ids and addresses, every call is recorded, and calls can be
+// made to fail or take longer.
 package fake
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/andrewsmedina/yati/tsuru/iaas"
 )
 
+// Default is the provider registered as "fake".
+var Default = &Iaas{}
+
 func init() {
-	iaas.Register("fake", &fakeIaas{})
+	iaas.MustRegister("fake", Default)
+}
+
+// Call is a call made to CreateMachine or DeleteMachine.
+type Call struct {
+	Method string
+	// Params are the params given to CreateMachine.
+	Params map[string]string
+	// Machine is the id of the machine created or deleted. It's empty when
+	// CreateMachine fails.
+	Machine string
+	Err     error
+}
+
+// Iaas keeps the machines in memory. The nth created machine gets the id
+// fake-n and the address 10.0.0.n, unless Address or the address param is
+// set.
+type Iaas struct {
+	// Address is the address of the created machines.
+	Address string
+	// Port is the Docker port of the created machines.
+	Port int
+
+	mu             sync.Mutex
+	latency        time.Duration
+	machines       []*iaas.Machine
+	next           int
+	creates        int
+	calls          []Call
+	createFailures map[int]error
+	deleteFailures map[string]error
+}
+
+// SetLatency makes CreateMachine and DeleteMachine wait for d before
+// running, so calls made at the same time overlap.
+func (i *Iaas) SetLatency(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.latency = d
+}
+
+func (i *Iaas) wait() {
+	i.mu.Lock()
+	d := i.latency
+	i.mu.Unlock()
+	time.Sleep(d)
+}
+
+// FailCreate makes the nth call to CreateMachine return err, counting from
+// 1 since the last Reset. A nil err removes the failure.
+func (i *Iaas) FailCreate(n int, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.createFailures == nil {
+		i.createFailures = make(map[int]error)
+	}
+	i.createFailures[n] = err
+}
+
+// FailDelete makes DeleteMachine return err for the machine with the given
+// id, keeping the machine. A nil err removes the failure.
+func (i *Iaas) FailDelete(id string, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.deleteFailures == nil {
+		i.deleteFailures = make(map[string]error)
+	}
+	i.deleteFailures[id] = err
+}
+
+// Calls returns the calls made to CreateMachine and DeleteMachine, in order.
+func (i *Iaas) Calls() []Call {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	calls := make([]Call, len(i.calls))
+	copy(calls, i.calls)
+	return calls
+}
+
+// Machines returns the ids of the machines that weren't deleted.
+func (i *Iaas) Machines() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	ids := make([]string, len(i.machines))
+	for j, m := range i.machines {
+		ids[j] = m.Id
+	}
+	return ids
 }
 
-type fakeIaas struct{}
+// Reset removes the machines, calls and failures, and restarts the ids.
+// Address, Port and the latency are kept.
+func (i *Iaas) Reset() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.machines = nil
+	i.next = 0
+	i.creates = 0
+	i.calls = nil
+	i.createFailures = nil
+	i.deleteFailures = nil
+}
 
-func (i *fakeIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
-	return &iaas.Machine{}, nil
+func (i *Iaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	i.wait()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.creates++
+	call := Call{Method: "CreateMachine", Params: params}
+	if err := i.createFailures[i.creates]; err != nil {
+		call.Err = err
+		i.calls = append(i.calls, call)
+		return nil, err
+	}
+	i.next++
+	m := &iaas.Machine{
+		Id:             fmt.Sprintf("fake-%d", i.next),
+		Iaas:           "fake",
+		Status:         "running",
+		Address:        params["address"],
+		Port:           i.Port,
+		CreationParams: params,
+	}
+	if m.Address == "" {
+		m.Address = i.Address
+	}
+	if m.Address == "" {
+		m.Address = fmt.Sprintf("10.0.0.%d", i.next)
+	}
+	i.machines = append(i.machines, m)
+	call.Machine = m.Id
+	i.calls = append(i.calls, call)
+	return m, nil
 }
 
-func (i *fakeIaas) DeleteMachine(m *iaas.Machine) error {
+// DeleteMachine removes the machine. Deleting a machine that doesn't exist
+// isn't an error.
+func (i *Iaas) DeleteMachine(m *iaas.Machine) error {
+	i.wait()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	call := Call{Method: "DeleteMachine", Machine: m.Id, Err: i.deleteFailures[m.Id]}
+	i.calls = append(i.calls, call)
+	if call.Err != nil {
+		return call.Err
+	}
+	for j, machine := range i.machines {
+		if machine.Id == m.Id {
+			i.machines = append(i.machines[:j], i.machines[j+1:]...)
+			break
+		}
+	}
 	return nil
 }
+
+func (i *Iaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	machines := make([]*iaas.Machine, len(i.machines))
+	copy(machines, i.machines)
+	return machines, nil
+}
+
+func (i *Iaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, current := range i.machines {
+		if current.Id == m.Id {
+			return current, nil
+		}
+	}
+	return nil, iaas.ErrMachineNotFound
+}
+
+func (i *Iaas) Describe() string {
+	return `Fake IaaS, the machines are kept in memory.
+
+Optional params:
+  address=<address>        Address of the created machines, defaults to
+                           10.0.0.<n>
+`
+}
+
+func (i *Iaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "address", Usage: "Address of the created machines, defaults to 10.0.0.<n>"},
+	}
+}
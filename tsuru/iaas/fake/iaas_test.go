@@ -0,0 +1,136 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fake
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct{}
+
+var _ = check.Suite(&S{})
+
+func (s *S) TestMachines(c *check.C) {
+	provider := &Iaas{}
+	m1, err := provider.CreateMachine(map[string]string{"address": "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.Id, check.Equals, "fake-1")
+	c.Assert(m1.Address, check.Equals, "10.0.0.1")
+	m2, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	machines, err := provider.ListMachines(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.DeepEquals, []*iaas.Machine{m1, m2})
+	m, err := provider.GetMachine(&iaas.Machine{Id: "fake-2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.Equals, m2)
+	err = provider.DeleteMachine(m1)
+	c.Assert(err, check.IsNil)
+	_, err = provider.GetMachine(m1)
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+	machines, err = provider.ListMachines(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.DeepEquals, []*iaas.Machine{m2})
+}
+
+func (s *S) TestDefaultAddresses(c *check.C) {
+	provider := &Iaas{}
+	m1, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.Address, check.Equals, "10.0.0.1")
+	provider.Address = "127.0.0.1"
+	provider.Port = 2375
+	m2, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(m2.Address, check.Equals, "127.0.0.1")
+	c.Assert(m2.Port, check.Equals, 2375)
+}
+
+func (s *S) TestCalls(c *check.C) {
+	provider := &Iaas{}
+	params := map[string]string{"address": "10.0.0.1"}
+	m, err := provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	err = provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	err = provider.DeleteMachine(&iaas.Machine{Id: "unknown"})
+	c.Assert(err, check.IsNil)
+	c.Assert(provider.Calls(), check.DeepEquals, []Call{
+		{Method: "CreateMachine", Params: params, Machine: "fake-1"},
+		{Method: "DeleteMachine", Machine: "fake-1"},
+		{Method: "DeleteMachine", Machine: "unknown"},
+	})
+	c.Assert(provider.Machines(), check.HasLen, 0)
+}
+
+func (s *S) TestFailCreate(c *check.C) {
+	provider := &Iaas{}
+	failure := errors.New("quota exceeded")
+	provider.FailCreate(2, failure)
+	_, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	_, err = provider.CreateMachine(nil)
+	c.Assert(err, check.Equals, failure)
+	m, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Id, check.Equals, "fake-2")
+	c.Assert(provider.Machines(), check.DeepEquals, []string{"fake-1", "fake-2"})
+	c.Assert(provider.Calls()[1], check.DeepEquals, Call{Method: "CreateMachine", Err: failure})
+}
+
+func (s *S) TestFailDelete(c *check.C) {
+	provider := &Iaas{}
+	m, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	failure := errors.New("machine is locked")
+	provider.FailDelete("fake-1", failure)
+	err = provider.DeleteMachine(m)
+	c.Assert(err, check.Equals, failure)
+	c.Assert(provider.Machines(), check.DeepEquals, []string{"fake-1"})
+	provider.FailDelete("fake-1", nil)
+	err = provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(provider.Machines(), check.HasLen, 0)
+}
+
+func (s *S) TestLatency(c *check.C) {
+	provider := &Iaas{}
+	provider.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	m, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	err = provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(time.Since(start) >= 40*time.Millisecond, check.Equals, true)
+}
+
+func (s *S) TestReset(c *check.C) {
+	provider := &Iaas{Address: "127.0.0.1"}
+	provider.FailCreate(2, errors.New("quota exceeded"))
+	_, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	provider.Reset()
+	c.Assert(provider.Machines(), check.HasLen, 0)
+	c.Assert(provider.Calls(), check.HasLen, 0)
+	m, err := provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Id, check.Equals, "fake-1")
+	c.Assert(m.Address, check.Equals, "127.0.0.1")
+	_, err = provider.CreateMachine(nil)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("fake")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s).*address=<address>.*")
+}
@@ -1,13 +1,69 @@
 package iaas
 
-var iaasProviders = make(map[string]Iaas)
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
 
-func Register(name string, provider Iaas) {
+// ErrMachineNotFound is returned by GetMachine when the machine doesn't
+// exist.
+var ErrMachineNotFound = errors.New("machine not found")
+
+var (
+	providersMu   sync.RWMutex
+	iaasProviders = make(map[string]Iaas)
+)
+
+// Register makes the provider available under the given name. It fails if
+// the name is already taken.
+func Register(name string, provider Iaas) error {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	if _, ok := iaasProviders[name]; ok {
+		return fmt.Errorf("iaas %q is already registered", name)
+	}
 	iaasProviders[name] = provider
+	return nil
 }
 
-func Get(name string) Iaas {
-	return iaasProviders[name]
+// MustRegister is like Register, but panics on errors. It's meant to be
+// called by providers in their init functions.
+func MustRegister(name string, provider Iaas) {
+	err := Register(name, provider)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Get returns the provider registered under the given name.
+func Get(name string) (Iaas, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := iaasProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("iaas %q is not registered, available: %s", name, strings.Join(list(), ", "))
+	}
+	return provider, nil
+}
+
+// List returns the sorted names of the registered providers.
+func List() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	return list()
+}
+
+func list() []string {
+	names := make([]string, 0, len(iaasProviders))
+	for name := range iaasProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 type Machine struct {
@@ -17,9 +73,217 @@ type Machine struct {
 	Address        string
 	Port           int
 	CreationParams map[string]string
+	// CaCert, ClientCert and ClientKey are the paths of the certificates
+	// used to talk to the Docker daemon with TLS. They're empty when the
+	// daemon doesn't use TLS.
+	CaCert     string
+	ClientCert string
+	ClientKey  string
+	// TLSServerName is the name in the certificate of the Docker daemon,
+	// checked instead of Address when it's set.
+	TLSServerName string
+	// Endpoint is the address of the Docker daemon when it isn't reachable
+	// at Address and Port, like a unix socket.
+	Endpoint string
 }
 
 type Iaas interface {
 	CreateMachine(params map[string]string) (*Machine, error)
 	DeleteMachine(m *Machine) error
+	// ListMachines returns the machines that exist in the iaas, looking
+	// for them where CreateMachine would create a machine with the given
+	// params, like the region.
+	ListMachines(params map[string]string) ([]*Machine, error)
+	// GetMachine returns the given machine with its current status and
+	// address. It's reached using the machine's CreationParams.
+	GetMachine(m *Machine) (*Machine, error)
+}
+
+// Describer is implemented by providers that describe the params they
+// accept.
+type Describer interface {
+	Describe() string
+}
+
+// FlagType is the type of the value of a Flag.
+type FlagType int
+
+const (
+	StringFlag FlagType = iota
+	IntFlag
+	BoolFlag
+)
+
+// Flag describes a param accepted by a provider. The flags of a provider are
+// the schema of its params, checked by ValidateParams, and can also be given
+// in the command line.
+type Flag struct {
+	Name     string
+	Usage    string
+	Type     FlagType
+	Required bool
+	// Value is the default value of the param, filled in by ValidateParams
+	// when the param is missing.
+	Value string
+	// Values are the allowed values of the param. Any value is allowed when
+	// it's empty.
+	Values []string
+}
+
+// Flagger is implemented by providers that declare the params they accept
+// as flags.
+type Flagger interface {
+	Flags() []Flag
+}
+
+// Flags returns the flags of the named provider, or nil if it doesn't
+// implement Flagger.
+func Flags(name string) ([]Flag, error) {
+	provider, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	flagger, ok := provider.(Flagger)
+	if !ok {
+		return nil, nil
+	}
+	return flagger.Flags(), nil
+}
+
+// ParamsError lists the problems found in the params of a provider.
+type ParamsError struct {
+	Iaas     string
+	Problems []string
+}
+
+func (e *ParamsError) Error() string {
+	return fmt.Sprintf("invalid params for iaas %q:\n  %s", e.Iaas, strings.Join(e.Problems, "\n  "))
+}
+
+// ValidateParams checks the params against the flags of the named provider,
+// reporting every problem found. It returns a copy of the params with the
+// defaults filled in and the integers and booleans normalized. The params of
+// providers that don't implement Flagger are returned unchecked.
+func ValidateParams(name string, params map[string]string) (map[string]string, error) {
+	flags, err := Flags(name)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string, len(params))
+	for k, v := range params {
+		result[k] = v
+	}
+	if flags == nil {
+		return result, nil
+	}
+	known := make(map[string]bool, len(flags))
+	var problems []string
+	for _, f := range flags {
+		known[f.Name] = true
+		v, ok := result[f.Name]
+		if !ok || v == "" {
+			if f.Required {
+				problems = append(problems, fmt.Sprintf("the parameter %q is required", f.Name))
+			} else if f.Value != "" {
+				result[f.Name] = f.Value
+			}
+			continue
+		}
+		switch f.Type {
+		case IntFlag:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("invalid value %q for param %q, it must be an integer", v, f.Name))
+				continue
+			}
+			result[f.Name] = strconv.Itoa(n)
+		case BoolFlag:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("invalid value %q for param %q, it must be a boolean", v, f.Name))
+				continue
+			}
+			result[f.Name] = strconv.FormatBool(b)
+		}
+		if len(f.Values) > 0 && !contains(f.Values, result[f.Name]) {
+			problems = append(problems, fmt.Sprintf("invalid value %q for param %q, it must be one of %s", v, f.Name, strings.Join(f.Values, ", ")))
+		}
+	}
+	var unknown []string
+	for k := range result {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		problems = append(problems, fmt.Sprintf("unknown param %q", k))
+	}
+	if len(problems) > 0 {
+		return nil, &ParamsError{Iaas: name, Problems: problems}
+	}
+	return result, nil
+}
+
+// IntParam returns the value of an integer param, or def when the param is
+// missing. Providers use it on params validated as an IntFlag.
+func IntParam(params map[string]string, name string, def int) (int, error) {
+	v := params[name]
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for param %q, it must be an integer", v, name)
+	}
+	return n, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe returns the description of the named provider, or an empty
+// string if it doesn't implement Describer.
+func Describe(name string) (string, error) {
+	provider, err := Get(name)
+	if err != nil {
+		return "", err
+	}
+	desc, ok := provider.(Describer)
+	if !ok {
+		return "", nil
+	}
+	return desc.Describe(), nil
+}
+
+// DockerChecker is implemented by providers whose machines don't always run
+// a Docker daemon reachable at their address and port. CheckDocker tells why
+// the machines created with the params can't run the tsuru components.
+type DockerChecker interface {
+	CheckDocker(params map[string]string) error
+}
+
+// CheckDocker returns an error if the machines created by the named provider
+// with the given params don't run Docker. Providers that don't implement
+// DockerChecker are assumed to run it.
+func CheckDocker(name string, params map[string]string) error {
+	provider, err := Get(name)
+	if err != nil {
+		return err
+	}
+	checker, ok := provider.(DockerChecker)
+	if !ok {
+		return nil
+	}
+	err = checker.CheckDocker(params)
+	if err != nil {
+		return fmt.Errorf("iaas %q can't be used to install tsuru: %s", name, err)
+	}
+	return nil
 }
@@ -1,6 +1,11 @@
 package iaas
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 
 	"gopkg.in/check.v1"
@@ -22,8 +27,212 @@ func (i *iaasTest) DeleteMachine(m *Machine) error {
 	return nil
 }
 
+func (i *iaasTest) ListMachines(params map[string]string) ([]*Machine, error) {
+	return nil, nil
+}
+
+func (i *iaasTest) GetMachine(m *Machine) (*Machine, error) {
+	return nil, ErrMachineNotFound
+}
+
+type describedIaasTest struct {
+	iaasTest
+}
+
+func (i *describedIaasTest) Describe() string {
+	return "params: none"
+}
+
 func (s *S) TestRegister(c *check.C) {
-	Register("abc", &iaasTest{})
-	provider := Get("abc")
+	err := Register("abc", &iaasTest{})
+	c.Assert(err, check.IsNil)
+	provider, err := Get("abc")
+	c.Assert(err, check.IsNil)
+	c.Assert(provider, check.FitsTypeOf, &iaasTest{})
+}
+
+func (s *S) TestRegisterDuplicated(c *check.C) {
+	err := Register("duplicated", &iaasTest{})
+	c.Assert(err, check.IsNil)
+	err = Register("duplicated", &describedIaasTest{})
+	c.Assert(err, check.ErrorMatches, `iaas "duplicated" is already registered`)
+	provider, err := Get("duplicated")
+	c.Assert(err, check.IsNil)
 	c.Assert(provider, check.FitsTypeOf, &iaasTest{})
 }
+
+func (s *S) TestMustRegisterDuplicated(c *check.C) {
+	MustRegister("must", &iaasTest{})
+	c.Assert(func() { MustRegister("must", &iaasTest{}) }, check.PanicMatches, `iaas "must" is already registered`)
+}
+
+func (s *S) TestRegisterConcurrently(c *check.C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			Register(fmt.Sprintf("concurrent-%d", i), &iaasTest{})
+			List()
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 10; i++ {
+		_, err := Get(fmt.Sprintf("concurrent-%d", i))
+		c.Assert(err, check.IsNil)
+	}
+}
+
+func (s *S) TestGetNotRegistered(c *check.C) {
+	Register("listed", &iaasTest{})
+	_, err := Get("unknown")
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*\blisted\b.*`)
+}
+
+func (s *S) TestList(c *check.C) {
+	Register("list-b", &iaasTest{})
+	Register("list-a", &iaasTest{})
+	names := List()
+	c.Assert(sort.StringsAreSorted(names), check.Equals, true)
+	var found []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "list-") {
+			found = append(found, name)
+		}
+	}
+	c.Assert(found, check.DeepEquals, []string{"list-a", "list-b"})
+}
+
+type flaggedIaasTest struct {
+	iaasTest
+}
+
+func (i *flaggedIaasTest) Flags() []Flag {
+	return []Flag{{Name: "memory", Usage: "Memory of the machine", Type: IntFlag, Value: "1024"}}
+}
+
+func (s *S) TestFlags(c *check.C) {
+	Register("flagged", &flaggedIaasTest{})
+	flags, err := Flags("flagged")
+	c.Assert(err, check.IsNil)
+	c.Assert(flags, check.DeepEquals, []Flag{{Name: "memory", Usage: "Memory of the machine", Type: IntFlag, Value: "1024"}})
+}
+
+func (s *S) TestFlagsNotFlagger(c *check.C) {
+	Register("not-flagged", &iaasTest{})
+	flags, err := Flags("not-flagged")
+	c.Assert(err, check.IsNil)
+	c.Assert(flags, check.IsNil)
+}
+
+func (s *S) TestFlagsNotRegistered(c *check.C) {
+	_, err := Flags("unknown")
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+type schemaIaasTest struct {
+	iaasTest
+}
+
+func (i *schemaIaasTest) Flags() []Flag {
+	return []Flag{
+		{Name: "image", Required: true},
+		{Name: "memory", Type: IntFlag, Value: "1024"},
+		{Name: "debug", Type: BoolFlag},
+		{Name: "size", Value: "small", Values: []string{"small", "large"}},
+	}
+}
+
+func (s *S) TestValidateParams(c *check.C) {
+	Register("schema", &schemaIaasTest{})
+	input := map[string]string{"image": "ubuntu", "memory": "+2048", "debug": "1"}
+	params, err := ValidateParams("schema", input)
+	c.Assert(err, check.IsNil)
+	c.Assert(params, check.DeepEquals, map[string]string{"image": "ubuntu", "memory": "2048", "debug": "true", "size": "small"})
+	c.Assert(input, check.DeepEquals, map[string]string{"image": "ubuntu", "memory": "+2048", "debug": "1"})
+}
+
+func (s *S) TestValidateParamsReportsEveryProblem(c *check.C) {
+	Register("schema", &schemaIaasTest{})
+	_, err := ValidateParams("schema", map[string]string{
+		"memory": "lots",
+		"debug":  "maybe",
+		"size":   "huge",
+		"imgae":  "ubuntu",
+		"zone":   "a",
+	})
+	c.Assert(err, check.FitsTypeOf, &ParamsError{})
+	c.Assert(err.(*ParamsError).Problems, check.DeepEquals, []string{
+		`the parameter "image" is required`,
+		`invalid value "lots" for param "memory", it must be an integer`,
+		`invalid value "maybe" for param "debug", it must be a boolean`,
+		`invalid value "huge" for param "size", it must be one of small, large`,
+		`unknown param "imgae"`,
+		`unknown param "zone"`,
+	})
+	c.Assert(err, check.ErrorMatches, `(?s)invalid params for iaas "schema":\n  the parameter "image" is required\n.*`)
+}
+
+func (s *S) TestValidateParamsNotFlagger(c *check.C) {
+	Register("not-flagged", &iaasTest{})
+	params, err := ValidateParams("not-flagged", map[string]string{"anything": "goes"})
+	c.Assert(err, check.IsNil)
+	c.Assert(params, check.DeepEquals, map[string]string{"anything": "goes"})
+}
+
+func (s *S) TestIntParam(c *check.C) {
+	n, err := IntParam(map[string]string{"wait-timeout": "60"}, "wait-timeout", 300)
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 60)
+	n, err = IntParam(map[string]string{}, "wait-timeout", 300)
+	c.Assert(err, check.IsNil)
+	c.Assert(n, check.Equals, 300)
+	_, err = IntParam(map[string]string{"wait-timeout": "soon"}, "wait-timeout", 300)
+	c.Assert(err, check.ErrorMatches, `invalid value "soon" for param "wait-timeout", it must be an integer`)
+}
+
+func (s *S) TestValidateParamsNotRegistered(c *check.C) {
+	_, err := ValidateParams("unknown", nil)
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	Register("described", &describedIaasTest{})
+	desc, err := Describe("described")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Equals, "params: none")
+}
+
+func (s *S) TestDescribeNotDescriber(c *check.C) {
+	Register("not-described", &iaasTest{})
+	desc, err := Describe("not-described")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Equals, "")
+}
+
+func (s *S) TestDescribeNotRegistered(c *check.C) {
+	_, err := Describe("unknown")
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+type noDockerIaasTest struct {
+	iaasTest
+}
+
+func (i *noDockerIaasTest) CheckDocker(params map[string]string) error {
+	if params["install-docker"] == "true" {
+		return nil
+	}
+	return errors.New("its machines don't run Docker")
+}
+
+func (s *S) TestCheckDocker(c *check.C) {
+	Register("no-docker", &noDockerIaasTest{})
+	err := CheckDocker("no-docker", nil)
+	c.Assert(err, check.ErrorMatches, `iaas "no-docker" can't be used to install tsuru: its machines don't run Docker`)
+	err = CheckDocker("no-docker", map[string]string{"install-docker": "true"})
+	c.Assert(err, check.IsNil)
+	Register("not-checked", &iaasTest{})
+	c.Assert(CheckDocker("not-checked", nil), check.IsNil)
+	c.Assert(CheckDocker("unknown", nil), check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
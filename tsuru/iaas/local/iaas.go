@@ -0,0 +1,187 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package local provides an iaas for the Docker daemon of the current host,
+// so tsuru can be installed without creating any machine.
+package local
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+const machineID = "local"
+
+// bridgeInterface is the interface whose address is used by containers to
+// reach the host when the daemon listens on a unix socket.
+var bridgeInterface = "docker0"
+
+func init() {
+	iaas.MustRegister("local", &localIaas{})
+}
+
+// localIaas returns a single machine pointing at the Docker daemon from
+// DOCKER_HOST, or the default unix socket. DOCKER_TLS_VERIFY and
+// DOCKER_CERT_PATH are honored like in the docker client.
+type localIaas struct {
+	// dockerHost overrides DOCKER_HOST.
+	dockerHost string
+}
+
+func (i *localIaas) Describe() string {
+	return `Local IaaS optional params:
+  address=<address>          Address used to reach the containers, defaults to
+                             the host of DOCKER_HOST or the docker0 address
+
+The Docker daemon is read from DOCKER_HOST, DOCKER_TLS_VERIFY and
+DOCKER_CERT_PATH, defaulting to the unix socket.
+`
+}
+
+func (i *localIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "address", Usage: "Address used to reach the containers, defaults to the host of DOCKER_HOST or the docker0 address"},
+	}
+}
+
+// machine returns the machine of the Docker daemon, without checking that
+// it's reachable.
+func (i *localIaas) machine(params map[string]string) (*iaas.Machine, error) {
+	host := i.dockerHost
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		var err error
+		host, err = docker.DefaultDockerHost()
+		if err != nil {
+			return nil, err
+		}
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DOCKER_HOST %q: %s", host, err)
+	}
+	m := &iaas.Machine{
+		Id:       machineID,
+		Iaas:     "local",
+		Status:   "running",
+		Address:  params["address"],
+		Endpoint: host,
+	}
+	if m.Address == "" {
+		switch u.Scheme {
+		case "unix":
+			m.Address, err = bridgeAddress()
+			if err != nil {
+				return nil, err
+			}
+		case "tcp":
+			m.Address, _, err = net.SplitHostPort(u.Host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DOCKER_HOST %q: %s", host, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid DOCKER_HOST %q: unsupported scheme", host)
+		}
+	}
+	if os.Getenv("DOCKER_TLS_VERIFY") != "" {
+		certPath := os.Getenv("DOCKER_CERT_PATH")
+		if certPath == "" {
+			certPath = cmd.JoinWithUserDir(".docker")
+		}
+		m.CaCert = filepath.Join(certPath, "ca.pem")
+		m.ClientCert = filepath.Join(certPath, "cert.pem")
+		m.ClientKey = filepath.Join(certPath, "key.pem")
+	}
+	return m, nil
+}
+
+// bridgeAddress returns the IPv4 address of the bridge interface.
+func bridgeAddress() (string, error) {
+	iface, err := net.InterfaceByName(bridgeInterface)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the address of %s, set the address param: %s", bridgeInterface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%s has no IPv4 address, set the address param", bridgeInterface)
+}
+
+func ping(m *iaas.Machine) error {
+	var client *docker.Client
+	var err error
+	if m.ClientCert != "" {
+		client, err = docker.NewTLSClient(m.Endpoint, m.ClientCert, m.ClientKey, m.CaCert)
+	} else {
+		client, err = docker.NewClient(m.Endpoint)
+	}
+	if err == nil {
+		err = client.Ping()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to connect to the Docker daemon at %s: %s", m.Endpoint, err)
+	}
+	return nil
+}
+
+// CreateMachine checks that the Docker daemon is reachable and returns it.
+func (i *localIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	m, err := i.machine(params)
+	if err != nil {
+		return nil, err
+	}
+	err = ping(m)
+	if err != nil {
+		return nil, err
+	}
+	m.CreationParams = params
+	return m, nil
+}
+
+// DeleteMachine does nothing, the Docker daemon is left running. The
+// containers are removed by the installer.
+func (i *localIaas) DeleteMachine(m *iaas.Machine) error {
+	return nil
+}
+
+// ListMachines returns the local machine.
+func (i *localIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	m, err := i.GetMachine(&iaas.Machine{Id: machineID, CreationParams: params})
+	if err != nil {
+		return nil, err
+	}
+	return []*iaas.Machine{m}, nil
+}
+
+// GetMachine returns the local machine, with status unreachable when the
+// Docker daemon doesn't answer.
+func (i *localIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	if m.Id != machineID {
+		return nil, iaas.ErrMachineNotFound
+	}
+	current, err := i.machine(m.CreationParams)
+	if err != nil {
+		return nil, err
+	}
+	if ping(current) != nil {
+		current.Status = "unreachable"
+	}
+	current.CreationParams = m.CreationParams
+	return current, nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package local
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	server   *dtesting.DockerServer
+	provider *localIaas
+	env      map[string]string
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	bridgeInterface = "lo"
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.env = make(map[string]string)
+	for _, name := range []string{"DOCKER_HOST", "DOCKER_TLS_VERIFY", "DOCKER_CERT_PATH"} {
+		s.env[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+	var err error
+	s.server, err = dtesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	u, err := url.Parse(s.server.URL())
+	c.Assert(err, check.IsNil)
+	s.provider = &localIaas{dockerHost: "tcp://" + u.Host}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	s.server.Stop()
+	for name, value := range s.env {
+		os.Setenv(name, value)
+	}
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := map[string]string{}
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             "local",
+		Iaas:           "local",
+		Status:         "running",
+		Address:        "127.0.0.1",
+		Endpoint:       s.provider.dockerHost,
+		CreationParams: params,
+	})
+}
+
+func (s *S) TestCreateMachineAddress(c *check.C) {
+	m, err := s.provider.CreateMachine(map[string]string{"address": "192.168.50.4"})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Address, check.Equals, "192.168.50.4")
+	c.Assert(m.Endpoint, check.Equals, s.provider.dockerHost)
+}
+
+func (s *S) TestCreateMachineUnixSocket(c *check.C) {
+	socket := filepath.Join(c.MkDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	c.Assert(err, check.IsNil)
+	defer listener.Close()
+	go http.Serve(listener, s.server)
+	os.Setenv("DOCKER_HOST", "unix://"+socket)
+	s.provider.dockerHost = ""
+	m, err := s.provider.CreateMachine(map[string]string{})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Endpoint, check.Equals, "unix://"+socket)
+	c.Assert(m.Address, check.Equals, "127.0.0.1")
+}
+
+func (s *S) TestCreateMachineUnreachable(c *check.C) {
+	s.server.Stop()
+	_, err := s.provider.CreateMachine(map[string]string{})
+	c.Assert(err, check.ErrorMatches, "unable to connect to the Docker daemon at tcp://.*")
+}
+
+func (s *S) TestCreateMachineInvalidHost(c *check.C) {
+	s.provider.dockerHost = "ftp://127.0.0.1"
+	_, err := s.provider.CreateMachine(map[string]string{})
+	c.Assert(err, check.ErrorMatches, `invalid DOCKER_HOST "ftp://127.0.0.1": unsupported scheme`)
+}
+
+func (s *S) TestMachineTLS(c *check.C) {
+	os.Setenv("DOCKER_TLS_VERIFY", "1")
+	os.Setenv("DOCKER_CERT_PATH", "/certs")
+	m, err := s.provider.machine(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.CaCert, check.Equals, "/certs/ca.pem")
+	c.Assert(m.ClientCert, check.Equals, "/certs/cert.pem")
+	c.Assert(m.ClientKey, check.Equals, "/certs/key.pem")
+}
+
+func (s *S) TestBridgeAddressNotFound(c *check.C) {
+	bridgeInterface = "yati0"
+	defer func() { bridgeInterface = "lo" }()
+	_, err := bridgeAddress()
+	c.Assert(err, check.ErrorMatches, "unable to find the address of yati0, set the address param: .*")
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	m, err := s.provider.CreateMachine(map[string]string{})
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	machines, err := s.provider.ListMachines(map[string]string{"address": "10.0.0.2"})
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 1)
+	c.Assert(machines[0].Id, check.Equals, "local")
+	c.Assert(machines[0].Status, check.Equals, "running")
+	c.Assert(machines[0].Address, check.Equals, "10.0.0.2")
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	created, err := s.provider.CreateMachine(map[string]string{"address": "10.0.0.2"})
+	c.Assert(err, check.IsNil)
+	m, err := s.provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Status, check.Equals, "running")
+	c.Assert(m.Address, check.Equals, "10.0.0.2")
+	s.server.Stop()
+	m, err = s.provider.GetMachine(created)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Status, check.Equals, "unreachable")
+}
+
+func (s *S) TestGetMachineNotFound(c *check.C) {
+	_, err := s.provider.GetMachine(&iaas.Machine{Id: "other"})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("local")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s)Local IaaS optional params:.*")
+}
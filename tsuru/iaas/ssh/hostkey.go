@@ -0,0 +1,114 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tsuru/tsuru/cmd"
+	"golang.org/x/crypto/ssh"
+)
+
+// fingerprint returns the SHA256 fingerprint of the key, in the format shown
+// by ssh-keygen -l.
+func fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// checkHostKey checks the key of the SSH server. It must have the
+// fingerprint in the host-key param or, when the param isn't set, be the key
+// of the host in ~/.ssh/known_hosts.
+func (h *host) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if h.hostKey != "" {
+		if fp := fingerprint(key); fp != h.hostKey {
+			return fmt.Errorf("host key mismatch for %s: got %s, expected %s", h.sshAddress(), fp, h.hostKey)
+		}
+		return nil
+	}
+	return checkKnownHosts(cmd.JoinWithUserDir(".ssh", "known_hosts"), knownHostsName(h.address, h.port), key)
+}
+
+// knownHostsName returns the name of the host in the known_hosts file, with
+// the port only when it isn't the default one.
+func knownHostsName(address string, port int) string {
+	if port == defaultSSHPort {
+		return address
+	}
+	return "[" + address + "]:" + strconv.Itoa(port)
+}
+
+// checkKnownHosts looks for the keys of the host in the known_hosts file.
+// The key must be one of them, and hosts without keys in the file are
+// rejected too. Markers, like @cert-authority, aren't supported.
+func checkKnownHosts(path, name string, key ssh.PublicKey) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var found bool
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+		if !matchHosts(fields[0], name) {
+			continue
+		}
+		known, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return nil
+		}
+		found = true
+	}
+	if found {
+		return fmt.Errorf("host key mismatch for %s: %s is not the key in %s", name, fingerprint(key), path)
+	}
+	return fmt.Errorf("host key of %s not found in %s, add it with ssh-keyscan or set the host-key param to %s", name, path, fingerprint(key))
+}
+
+// matchHosts reports whether the name is in the comma separated hosts of a
+// known_hosts line, either in clear or hashed. Wildcards aren't supported.
+func matchHosts(hosts, name string) bool {
+	for _, h := range strings.Split(hosts, ",") {
+		if h == name || strings.HasPrefix(h, "|1|") && matchHashed(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHashed reports whether the hashed host, in the form |1|salt|hash,
+// is the name.
+func matchHashed(hashed, name string) bool {
+	parts := strings.Split(hashed, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), sum)
+}
@@ -0,0 +1,81 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestFingerprint(c *check.C) {
+	c.Assert(fingerprint(s.signer.PublicKey()), check.Matches, "SHA256:[A-Za-z0-9+/]{43}")
+}
+
+func (s *S) TestKnownHostsName(c *check.C) {
+	c.Assert(knownHostsName("10.0.0.1", 22), check.Equals, "10.0.0.1")
+	c.Assert(knownHostsName("10.0.0.1", 2222), check.Equals, "[10.0.0.1]:2222")
+}
+
+func (s *S) TestCheckKnownHosts(c *check.C) {
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.signer.PublicKey())))
+	mac := hmac.New(sha1.New, []byte("salt"))
+	mac.Write([]byte("[10.0.0.2]:2222"))
+	hashed := fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString([]byte("salt")), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	path := filepath.Join(c.MkDir(), "known_hosts")
+	data := fmt.Sprintf("# comment\nhost.example.com,10.0.0.1 %s\n%s %s\n", key, hashed, key)
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), check.IsNil)
+	c.Assert(checkKnownHosts(path, "10.0.0.1", s.signer.PublicKey()), check.IsNil)
+	c.Assert(checkKnownHosts(path, "[10.0.0.2]:2222", s.signer.PublicKey()), check.IsNil)
+	err := checkKnownHosts(path, "10.0.0.3", s.signer.PublicKey())
+	c.Assert(err, check.ErrorMatches, `host key of 10.0.0.3 not found in .*known_hosts, add it with ssh-keyscan or set the host-key param to SHA256:.*`)
+	err = checkKnownHosts(filepath.Join(c.MkDir(), "known_hosts"), "10.0.0.1", s.signer.PublicKey())
+	c.Assert(err, check.ErrorMatches, `host key of 10.0.0.1 not found in .*`)
+}
+
+func (s *S) TestCheckKnownHostsMismatch(c *check.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	other, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(c.MkDir(), "known_hosts")
+	data := "10.0.0.1 " + string(ssh.MarshalAuthorizedKey(other.PublicKey()))
+	c.Assert(ioutil.WriteFile(path, []byte(data), 0600), check.IsNil)
+	err = checkKnownHosts(path, "10.0.0.1", s.signer.PublicKey())
+	c.Assert(err, check.ErrorMatches, `host key mismatch for 10.0.0.1: SHA256:.* is not the key in .*known_hosts`)
+}
+
+func (s *S) TestCreateMachineHostKeyMismatch(c *check.C) {
+	params := s.params()
+	params["host-key"] = "SHA256:AAAA"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "unable to connect to .*: .*host key mismatch for .*: got SHA256:.*, expected SHA256:AAAA")
+	c.Assert(s.server.commands, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineKnownHosts(c *check.C) {
+	params := s.params()
+	delete(params, "host-key")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "unable to connect to .*: .*host key of .* not found in .*")
+	dir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	c.Assert(os.MkdirAll(dir, 0700), check.IsNil)
+	port, _ := strconv.Atoi(params["port"])
+	data := knownHostsName(params["address"], port) + " " + string(ssh.MarshalAuthorizedKey(s.signer.PublicKey()))
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(data), 0600), check.IsNil)
+	_, err = s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+}
@@ -0,0 +1,301 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ssh provides an iaas for hosts that already exist. Nothing is
+// created, the hosts are only checked over SSH and optionally get Docker
+// installed.
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/dockertls"
+	"github.com/tsuru/tsuru/cmd"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultUser       = "root"
+	defaultSSHPort    = 22
+	defaultDockerPort = 2375
+)
+
+// dialTimeout is the time to wait for the SSH connection.
+var dialTimeout = 30 * time.Second
+
+// uninstallScript removes Docker only if it was installed by the install
+// script of dockertls, purging the packages of Docker that are installed,
+// including the ones the Docker install script pulls along. The data of the
+// installations in /var/lib/yati is removed too, while the images and
+// containers in /var/lib/docker are kept.
+const uninstallScript = `set -e
+if [ -f /var/lib/yati/docker-installed ]; then
+  systemctl stop docker || true
+  rm -f /etc/systemd/system/docker.service.d/yati.conf
+  rm -rf /etc/docker/yati
+  for pkg in docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin docker-engine; do
+    if command -v dpkg >/dev/null 2>&1; then
+      if dpkg -s $pkg >/dev/null 2>&1; then
+        apt-get purge -y $pkg
+      fi
+    elif rpm -q $pkg >/dev/null 2>&1; then
+      yum remove -y $pkg
+    fi
+  done
+  systemctl daemon-reload || true
+fi
+rm -rf /var/lib/yati
+`
+
+func init() {
+	iaas.MustRegister("ssh", &sshIaas{})
+}
+
+// sshIaas uses hosts that already exist. The machine id is the address of
+// the SSH server, in the form host:port.
+type sshIaas struct{}
+
+// host is the SSH configuration of a machine, read from its params.
+type host struct {
+	address string
+	user    string
+	key     string
+	port    int
+	// dockerPort is the port of the Docker daemon, or zero for the
+	// default one.
+	dockerPort int
+	// hostKey is the fingerprint of the key of the SSH server. The
+	// server is checked against ~/.ssh/known_hosts when it's empty.
+	hostKey string
+}
+
+func (i *sshIaas) Describe() string {
+	return fmt.Sprintf(`SSH IaaS required params:
+  address=<address>          Address of the host
+
+Optional params:
+  user=<user>                SSH user, defaults to %s
+  key=<path>                 SSH private key, defaults to ~/.ssh/id_rsa
+  port=<port>                SSH port, defaults to %d
+  host-key=<fingerprint>     SHA256 fingerprint of the host key, checked
+                             against ~/.ssh/known_hosts when not set
+  install-docker=true        Install Docker with TLS when it's missing
+  docker-port=<port>         Port of the Docker daemon, defaults to %d
+                             when it's installed with TLS, %d otherwise
+
+Users other than root must be able to run sudo without a password.
+`, defaultUser, defaultSSHPort, dockertls.Port, defaultDockerPort)
+}
+
+func (i *sshIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "address", Usage: "Address of the host", Required: true},
+		{Name: "user", Usage: "SSH user", Value: defaultUser},
+		{Name: "key", Usage: "SSH private key, defaults to ~/.ssh/id_rsa"},
+		{Name: "port", Usage: "SSH port", Type: iaas.IntFlag, Value: strconv.Itoa(defaultSSHPort)},
+		{Name: "host-key", Usage: "SHA256 fingerprint of the host key, checked against ~/.ssh/known_hosts when not set"},
+		{Name: "install-docker", Usage: "Install Docker with TLS when it's missing", Type: iaas.BoolFlag},
+		{Name: "docker-port", Usage: fmt.Sprintf("Port of the Docker daemon, defaults to %d when it's installed with TLS, %d otherwise", dockertls.Port, defaultDockerPort), Type: iaas.IntFlag},
+	}
+}
+
+func parseHost(params map[string]string) (*host, error) {
+	h := &host{
+		address: params["address"],
+		user:    params["user"],
+		key:     params["key"],
+		hostKey: params["host-key"],
+		port:    defaultSSHPort,
+	}
+	if h.address == "" {
+		return nil, fmt.Errorf("the parameter %q is required", "address")
+	}
+	if h.user == "" {
+		h.user = defaultUser
+	}
+	if h.key == "" {
+		h.key = cmd.JoinWithUserDir(".ssh", "id_rsa")
+	}
+	for name, value := range map[string]*int{"port": &h.port, "docker-port": &h.dockerPort} {
+		if v := params[name]; v != "" {
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for param %q", v, name)
+			}
+			*value = port
+		}
+	}
+	return h, nil
+}
+
+func (h *host) sshAddress() string {
+	return net.JoinHostPort(h.address, strconv.Itoa(h.port))
+}
+
+// dial opens an SSH connection to the host, authenticating with its key and
+// checking the key of the server.
+func (h *host) dial() (*ssh.Client, error) {
+	key, err := ioutil.ReadFile(h.key)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key %s: %s", h.key, err)
+	}
+	conn, err := net.DialTimeout("tcp", h.sshAddress(), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            h.user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: h.checkHostKey,
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, h.sshAddress(), config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to connect to %s: %s", h.sshAddress(), err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// run runs the script in the host as root, returning its output.
+func (h *host) run(client *ssh.Client, script string) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	command := "sh -c " + shellQuote(script)
+	if h.user != "root" {
+		command = "sudo -n " + command
+	}
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(command)
+	if err != nil {
+		return "", fmt.Errorf("command failed in %s: %s: %s", h.address, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// certsDir is the directory where the client certificates of the Docker
+// daemon of the host are kept.
+func (h *host) certsDir() string {
+	return dockertls.CertsDir("ssh", h.address+"-"+strconv.Itoa(h.port))
+}
+
+// installDocker runs the install script of dockertls in the host. When
+// Docker is installed, or was installed by yati before, the client
+// certificates are saved in certsDir and set in the machine. Docker
+// installations left alone are expected to listen on the port without TLS.
+func (h *host) installDocker(client *ssh.Client, m *iaas.Machine) error {
+	certs, err := dockertls.GenerateCerts(h.address)
+	if err != nil {
+		return fmt.Errorf("unable to generate Docker certificates: %s", err)
+	}
+	port := h.dockerPort
+	if port == 0 {
+		port = dockertls.Port
+	}
+	out, err := h.run(client, dockertls.InstallScript(port, certs))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(out, dockertls.ExistingDocker) {
+		return nil
+	}
+	return dockertls.Save(h.certsDir(), certs, port, m)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CreateMachine checks that the host is reachable over SSH and installs
+// Docker with TLS in it when install-docker is true.
+func (i *sshIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	h, err := parseHost(params)
+	if err != nil {
+		return nil, err
+	}
+	client, err := h.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	m := &iaas.Machine{
+		Id:             h.sshAddress(),
+		Iaas:           "ssh",
+		Status:         "running",
+		Address:        h.address,
+		Port:           h.dockerPort,
+		CreationParams: params,
+	}
+	if m.Port == 0 {
+		m.Port = defaultDockerPort
+	}
+	if params["install-docker"] == "true" {
+		err = h.installDocker(client, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// DeleteMachine removes Docker from the host if it was installed by yati,
+// and the client certificates. The host itself is left alone.
+func (i *sshIaas) DeleteMachine(m *iaas.Machine) error {
+	if m.CreationParams["install-docker"] != "true" {
+		return nil
+	}
+	h, err := parseHost(m.CreationParams)
+	if err != nil {
+		return err
+	}
+	client, err := h.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, err = h.run(client, uninstallScript)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(h.certsDir())
+}
+
+// ListMachines returns no machines, since the hosts aren't managed by the
+// iaas.
+func (i *sshIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	return []*iaas.Machine{}, nil
+}
+
+// GetMachine reports whether the SSH server of the host accepts
+// connections. The status is either running or unreachable.
+func (i *sshIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	address, _, err := net.SplitHostPort(m.Id)
+	if err != nil {
+		return nil, iaas.ErrMachineNotFound
+	}
+	current := &iaas.Machine{Id: m.Id, Iaas: "ssh", Status: "running", Address: address, CreationParams: m.CreationParams}
+	conn, err := net.DialTimeout("tcp", m.Id, dialTimeout)
+	if err != nil {
+		current.Status = "unreachable"
+		return current, nil
+	}
+	conn.Close()
+	return current, nil
+}
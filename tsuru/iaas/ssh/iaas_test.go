@@ -0,0 +1,336 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/dockertls"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	home     string
+	dir      string
+	keyPath  string
+	signer   ssh.Signer
+	server   *fakeSSH
+	provider *sshIaas
+}
+
+var _ = check.Suite(&S{})
+
+func (s *S) SetUpSuite(c *check.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	s.signer, err = ssh.NewSignerFromKey(key)
+	c.Assert(err, check.IsNil)
+	s.dir, err = ioutil.TempDir("", "yati-ssh")
+	c.Assert(err, check.IsNil)
+	s.keyPath = filepath.Join(s.dir, "id_rsa")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	err = ioutil.WriteFile(s.keyPath, pem.EncodeToMemory(block), 0600)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TearDownSuite(c *check.C) {
+	os.RemoveAll(s.dir)
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	s.server = newFakeSSH(c, s.signer)
+	s.provider = &sshIaas{}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.listener.Close()
+}
+
+func (s *S) params() map[string]string {
+	host, port, _ := net.SplitHostPort(s.server.listener.Addr().String())
+	return map[string]string{
+		"address":  host,
+		"port":     port,
+		"user":     "ubuntu",
+		"key":      s.keyPath,
+		"host-key": fingerprint(s.signer.PublicKey()),
+	}
+}
+
+// fakeSSH is an SSH server that accepts the given key and records the
+// commands it runs. Commands print stdout, and fail when fail is set.
+type fakeSSH struct {
+	listener net.Listener
+	mu       sync.Mutex
+	users    []string
+	commands []string
+	stdout   string
+	fail     bool
+}
+
+func newFakeSSH(c *check.C, signer ssh.Signer) *fakeSSH {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	f := &fakeSSH{listener: listener}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), signer.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			f.mu.Lock()
+			f.users = append(f.users, conn.User())
+			f.mu.Unlock()
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn, config)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSSH) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go f.session(channel, requests)
+	}
+}
+
+func (f *fakeSSH) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		f.mu.Lock()
+		f.commands = append(f.commands, payload.Command)
+		status := uint32(0)
+		channel.Write([]byte(f.stdout))
+		if f.fail {
+			status = 1
+			channel.Stderr().Write([]byte("curl: not found\n"))
+		}
+		f.mu.Unlock()
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+		return
+	}
+}
+
+func (s *S) TestCreateMachine(c *check.C) {
+	params := s.params()
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, &iaas.Machine{
+		Id:             s.server.listener.Addr().String(),
+		Iaas:           "ssh",
+		Status:         "running",
+		Address:        "127.0.0.1",
+		Port:           2375,
+		CreationParams: params,
+	})
+	c.Assert(s.server.users, check.DeepEquals, []string{"ubuntu"})
+	c.Assert(s.server.commands, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachineInstallDocker(c *check.C) {
+	params := s.params()
+	params["install-docker"] = "true"
+	params["docker-port"] = "2377"
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Port, check.Equals, 2377)
+	c.Assert(s.server.commands, check.HasLen, 1)
+	c.Assert(strings.HasPrefix(s.server.commands[0], "sudo -n sh -c '"), check.Equals, true)
+	c.Assert(s.server.commands[0], check.Matches, "(?s).*get.docker.com.*tcp://0.0.0.0:2377 --tlsverify .*")
+	dir := filepath.Join(os.Getenv("HOME"), ".yati", "ssh", "127.0.0.1-"+params["port"])
+	c.Assert(m.CaCert, check.Equals, filepath.Join(dir, "ca.pem"))
+	c.Assert(m.ClientCert, check.Equals, filepath.Join(dir, "cert.pem"))
+	c.Assert(m.ClientKey, check.Equals, filepath.Join(dir, "key.pem"))
+	ca, err := ioutil.ReadFile(m.CaCert)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(s.server.commands[0], string(ca)), check.Equals, true)
+	key, err := ioutil.ReadFile(m.ClientKey)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(s.server.commands[0], string(key)), check.Equals, false)
+}
+
+func (s *S) TestCreateMachineInstallDockerDefaultPort(c *check.C) {
+	params := s.params()
+	params["install-docker"] = "true"
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Port, check.Equals, 2376)
+	c.Assert(s.server.commands[0], check.Matches, "(?s).*tcp://0.0.0.0:2376 --tlsverify .*")
+}
+
+func (s *S) TestCreateMachineExistingDocker(c *check.C) {
+	s.server.stdout = dockertls.ExistingDocker + "\n"
+	params := s.params()
+	params["install-docker"] = "true"
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Port, check.Equals, 2375)
+	c.Assert(m.ClientCert, check.Equals, "")
+	_, err = os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "ssh"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestCreateMachineInstallDockerAsRoot(c *check.C) {
+	params := s.params()
+	params["install-docker"] = "true"
+	delete(params, "user")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	c.Assert(s.server.users, check.DeepEquals, []string{"root"})
+	c.Assert(strings.HasPrefix(s.server.commands[0], "sh -c '"), check.Equals, true)
+}
+
+func (s *S) TestCreateMachineInstallDockerFailure(c *check.C) {
+	s.server.fail = true
+	params := s.params()
+	params["install-docker"] = "true"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "command failed in 127.0.0.1: .*: curl: not found")
+}
+
+func (s *S) TestCreateMachineRequiredParams(c *check.C) {
+	params := s.params()
+	delete(params, "address")
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, `the parameter "address" is required`)
+}
+
+func (s *S) TestCreateMachineInvalidPort(c *check.C) {
+	params := s.params()
+	params["docker-port"] = "abc"
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, `invalid value "abc" for param "docker-port"`)
+}
+
+func (s *S) TestCreateMachineWrongKey(c *check.C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	path := filepath.Join(s.dir, "other")
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	err = ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	c.Assert(err, check.IsNil)
+	params := s.params()
+	params["key"] = path
+	_, err = s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, "unable to connect to .*: .*unable to authenticate.*")
+}
+
+func (s *S) TestCreateMachineUnreachable(c *check.C) {
+	params := s.params()
+	s.server.listener.Close()
+	_, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.ErrorMatches, ".*connection refused")
+}
+
+func (s *S) TestDeleteMachine(c *check.C) {
+	params := s.params()
+	params["install-docker"] = "true"
+	m, err := s.provider.CreateMachine(params)
+	c.Assert(err, check.IsNil)
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(filepath.Dir(m.CaCert))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(s.server.commands, check.HasLen, 2)
+	c.Assert(s.server.commands[1], check.Matches, "(?s)sudo -n sh -c .*if \\[ -f /var/lib/yati/docker-installed \\].*")
+	c.Assert(s.server.commands[1], check.Not(check.Matches), "(?s).*rm -rf /var/lib/docker\\b.*")
+	c.Assert(s.server.commands[1], check.Matches, "(?s).*for pkg in docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin docker-engine; .*")
+	c.Assert(s.server.commands[1], check.Matches, "(?s).*if dpkg -s \\$pkg .*apt-get purge -y \\$pkg.*")
+	c.Assert(s.server.commands[1], check.Matches, "(?s).*\nfi\nrm -rf /var/lib/yati\n.*")
+}
+
+func (s *S) TestDeleteMachineWithoutDocker(c *check.C) {
+	m, err := s.provider.CreateMachine(s.params())
+	c.Assert(err, check.IsNil)
+	s.server.listener.Close()
+	err = s.provider.DeleteMachine(m)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *S) TestListMachines(c *check.C) {
+	machines, err := s.provider.ListMachines(s.params())
+	c.Assert(err, check.IsNil)
+	c.Assert(machines, check.HasLen, 0)
+}
+
+func (s *S) TestGetMachine(c *check.C) {
+	id := s.server.listener.Addr().String()
+	m, err := s.provider.GetMachine(&iaas.Machine{Id: id})
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, &iaas.Machine{Id: id, Iaas: "ssh", Status: "running", Address: "127.0.0.1"})
+	s.server.listener.Close()
+	m, err = s.provider.GetMachine(&iaas.Machine{Id: id})
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Status, check.Equals, "unreachable")
+}
+
+func (s *S) TestGetMachineInvalidID(c *check.C) {
+	_, err := s.provider.GetMachine(&iaas.Machine{Id: "127.0.0.1"})
+	c.Assert(err, check.Equals, iaas.ErrMachineNotFound)
+}
+
+func (s *S) TestShellQuote(c *check.C) {
+	c.Assert(shellQuote("echo 'hi'"), check.Equals, `'echo '\''hi'\'''`)
+}
+
+func (s *S) TestParseHostDefaults(c *check.C) {
+	h, err := parseHost(map[string]string{"address": "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(h.user, check.Equals, "root")
+	c.Assert(h.port, check.Equals, 22)
+	c.Assert(h.dockerPort, check.Equals, 0)
+	c.Assert(h.key, check.Equals, filepath.Join(os.Getenv("HOME"), ".ssh", "id_rsa"))
+	c.Assert(h.sshAddress(), check.Equals, "10.0.0.1:22")
+}
+
+func (s *S) TestDescribe(c *check.C) {
+	desc, err := iaas.Describe("ssh")
+	c.Assert(err, check.IsNil)
+	c.Assert(desc, check.Matches, "(?s)SSH IaaS required params:.*")
+}
@@ -0,0 +1,240 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/tsuru/action"
+)
+
+type installArgs struct {
+	out      io.Writer
+	config   *Config
+	provider iaas.Iaas
+	state    *State
+	client   *docker.Client
+	hooks    Hooks
+	undone   []string
+}
+
+// machine returns the machine where the tsuru components run.
+func (args *installArgs) machine() *iaas.Machine {
+	return args.state.Machines[0]
+}
+
+// containerID returns the id of the container running the named component.
+func (args *installArgs) containerID(component string) string {
+	for _, c := range args.state.Containers {
+		if c.Component == component {
+			return c.ID
+		}
+	}
+	return ""
+}
+
+// undo records that the step has been rolled back.
+func (args *installArgs) undo(name string, err error) {
+	if err != nil {
+		fmt.Fprintf(args.out, "Failed to undo %s: %s\n", name, err)
+		return
+	}
+	args.undone = append(args.undone, name)
+}
+
+// skipped is the result of a step finished in a previous run.
+type skipped struct{}
+
+// resumable wraps an install step, recording it in the state once it's
+// done. Steps finished in a previous run are skipped and never rolled back,
+// so the installation can be resumed or uninstalled later.
+func resumable(a *action.Action) *action.Action {
+	return &action.Action{
+		Name: a.Name,
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			args := ctx.Params[0].(*installArgs)
+			if args.state.finished(a.Name) {
+				fmt.Fprintf(args.out, "Skipping %s, already done.\n", a.Name)
+				return skipped{}, nil
+			}
+			result, err := a.Forward(ctx)
+			if err != nil {
+				return nil, err
+			}
+			args.state.Steps = append(args.state.Steps, a.Name)
+			err = args.state.Save()
+			if err != nil {
+				args.state.removeStep(a.Name)
+				if a.Backward != nil {
+					a.Backward(action.BWContext{Params: ctx.Params, FWResult: result})
+				}
+				return nil, fmt.Errorf("unable to save state: %s", err)
+			}
+			return result, nil
+		},
+		Backward: func(ctx action.BWContext) {
+			if _, ok := ctx.FWResult.(skipped); ok {
+				return
+			}
+			args := ctx.Params[0].(*installArgs)
+			args.state.removeStep(a.Name)
+			if a.Backward != nil {
+				a.Backward(ctx)
+			}
+		},
+		MinParams: a.MinParams,
+	}
+}
+
+// machineParams returns the params of the nth machine, counting from 0.
+// When there are many machines, the name param gets the number of the
+// machine as a suffix, so providers that require unique names don't fail.
+func machineParams(conf *Config, n int) map[string]string {
+	name, ok := conf.Iaas.Params["name"]
+	if !ok || name == "" || conf.Machines < 2 {
+		return conf.Iaas.Params
+	}
+	params := make(map[string]string, len(conf.Iaas.Params))
+	for k, v := range conf.Iaas.Params {
+		params[k] = v
+	}
+	params["name"] = fmt.Sprintf("%s-%d", name, n+1)
+	return params
+}
+
+func (args *installArgs) createMachine(n int) (*iaas.Machine, error) {
+	m, err := args.provider.CreateMachine(machineParams(args.config, n))
+	if err != nil {
+		return nil, err
+	}
+	if m.Address == "" {
+		args.provider.DeleteMachine(m)
+		return nil, errNoAddress
+	}
+	return m, nil
+}
+
+// deleteMachines deletes the given machines, removing them from the state.
+func (args *installArgs) deleteMachines(machines []*iaas.Machine) error {
+	for _, m := range machines {
+		err := args.provider.DeleteMachine(m)
+		if err != nil {
+			return fmt.Errorf("unable to delete machine %q: %s", m.Id, err)
+		}
+		args.state.removeMachine(m)
+	}
+	return nil
+}
+
+// createMachines creates the machines missing from the state. Each machine
+// is saved as soon as it's created, so an interrupted install never creates
+// it again. When every machine is rolled back, the state and its secrets go
+// away, so the data directories are removed too, or a new install would find
+// MongoDB users with other passwords. Machines of some iaas, like ssh,
+// outlive the installation.
+var createMachines = action.Action{
+	Name: "create-machines",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		var machines []*iaas.Machine
+		for i := len(args.state.Machines); i < args.config.Machines; i++ {
+			fmt.Fprintf(args.out, "Creating machine %d/%d using %q...\n", i+1, args.config.Machines, args.config.Iaas.Name)
+			m, err := args.createMachine(i)
+			if err == nil {
+				machines = append(machines, m)
+				args.state.Machines = append(args.state.Machines, m)
+				err = args.state.Save()
+			}
+			if err != nil {
+				args.deleteMachines(machines)
+				return nil, err
+			}
+		}
+		client, err := dockerClient(args.machine())
+		if err != nil {
+			args.deleteMachines(machines)
+			return nil, err
+		}
+		args.client = client
+		args.state.APIURL = apiURL(args.machine())
+		return machines, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		args := ctx.Params[0].(*installArgs)
+		machines := ctx.FWResult.([]*iaas.Machine)
+		if len(machines) == len(args.state.Machines) {
+			err := removeDataDirs(args.client, args.state.DataDirs)
+			if err != nil {
+				fmt.Fprintf(args.out, "Failed to remove the data directories: %s\n", err)
+			}
+		}
+		args.undo("create-machines", args.deleteMachines(machines))
+	},
+	MinParams: 1,
+}
+
+// startComponent returns the action that runs the given component in the
+// created machine. A container left behind by an interrupted install is
+// replaced.
+func startComponent(c *Component) *action.Action {
+	name := "start-" + c.Name
+	return &action.Action{
+		Name: name,
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			args := ctx.Params[0].(*installArgs)
+			fmt.Fprintf(args.out, "Starting %s...\n", c.Name)
+			err := removeContainer(args.client, c.Name)
+			if _, ok := err.(*docker.NoSuchContainer); err != nil && !ok {
+				return nil, fmt.Errorf("unable to start %s: %s", c.Name, err)
+			}
+			args.state.removeContainer(args.containerID(c.Name))
+			id, err := c.start(args.client, args.machine())
+			if err != nil {
+				return nil, fmt.Errorf("unable to start %s: %s", c.Name, err)
+			}
+			args.state.Containers = append(args.state.Containers, ContainerState{Component: c.Name, ID: id})
+			return id, nil
+		},
+		Backward: func(ctx action.BWContext) {
+			args := ctx.Params[0].(*installArgs)
+			id := ctx.FWResult.(string)
+			err := removeContainer(args.client, id)
+			if err == nil {
+				args.state.removeContainer(id)
+			}
+			args.undo(name, err)
+		},
+		MinParams: 1,
+	}
+}
+
+// createAdmin creates the admin user in the tsuru API. The user is stored in
+// MongoDB, whose data outlives the rollback when the machines are kept, so
+// it's removed there on rollback, or the next install would create it again.
+var createAdmin = action.Action{
+	Name: "create-admin",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		admin := args.config.Admin
+		fmt.Fprintf(args.out, "Creating admin user %s...\n", admin.Email)
+		input := fmt.Sprintf("%s\n%s\n", admin.Password, admin.Password)
+		cmd := []string{"tsurud", "root-user-create", admin.Email, "--config", tsuruConfigPath}
+		err := execInContainer(args.client, args.containerID("tsuru-api"), cmd, input)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create admin user: %s", err)
+		}
+		return admin.Email, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		args := ctx.Params[0].(*installArgs)
+		cmd := []string{"sh", "-c", fmt.Sprintf(mongoWaitScript, mongoSetupTimeout)}
+		script := mongoRemoveUserScript(args.config, ctx.FWResult.(string))
+		args.undo("create-admin", execInContainer(args.client, args.containerID("mongodb"), cmd, script))
+	},
+	MinParams: 1,
+}
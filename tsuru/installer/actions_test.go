@@ -0,0 +1,195 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/tsuru/action"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) newArgs() *installArgs {
+	return &installArgs{
+		out:      ioutil.Discard,
+		config:   testConfig(),
+		provider: testProvider,
+		state:    &State{Name: "tsuru", Iaas: "test-iaas"},
+	}
+}
+
+func (s *S) TestCreateMachinesName(c *check.C) {
+	c.Assert(createMachines.Name, check.Equals, "create-machines")
+}
+
+func (s *S) TestCreateMachinesForward(c *check.C) {
+	args := s.newArgs()
+	args.config.Machines = 2
+	result, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	machines := result.([]*iaas.Machine)
+	c.Assert(machines, check.HasLen, 2)
+	c.Assert(machines[0].Id, check.Equals, "test-machine-1")
+	c.Assert(machines[1].Id, check.Equals, "test-machine-2")
+	c.Assert(args.machine(), check.Equals, machines[0])
+	c.Assert(args.client, check.NotNil)
+	state, err := LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Machines, check.DeepEquals, machines)
+}
+
+func (s *S) TestCreateMachinesForwardNames(c *check.C) {
+	args := s.newArgs()
+	args.config.Machines = 2
+	args.config.Iaas.Params = map[string]string{"name": "tsuru", "driver": "virtualbox"}
+	_, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.created[0].CreationParams, check.DeepEquals, map[string]string{"name": "tsuru-1", "driver": "virtualbox"})
+	c.Assert(testProvider.created[1].CreationParams, check.DeepEquals, map[string]string{"name": "tsuru-2", "driver": "virtualbox"})
+	c.Assert(args.config.Iaas.Params["name"], check.Equals, "tsuru")
+}
+
+func (s *S) TestMachineParamsSingleMachine(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Params = map[string]string{"name": "tsuru"}
+	c.Assert(machineParams(conf, 0), check.DeepEquals, map[string]string{"name": "tsuru"})
+}
+
+func (s *S) TestCreateMachinesForwardResume(c *check.C) {
+	args := s.newArgs()
+	args.config.Machines = 2
+	existing := &iaas.Machine{Id: "existing", Address: testProvider.address, Port: testProvider.port}
+	args.state.Machines = []*iaas.Machine{existing}
+	result, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.DeepEquals, testProvider.created)
+	c.Assert(testProvider.created, check.HasLen, 1)
+	c.Assert(args.state.Machines, check.DeepEquals, []*iaas.Machine{existing, testProvider.created[0]})
+	c.Assert(args.machine(), check.Equals, existing)
+}
+
+func (s *S) TestCreateMachinesForwardWithoutAddress(c *check.C) {
+	args := s.newArgs()
+	testProvider.address = ""
+	_, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.Equals, errNoAddress)
+	c.Assert(testProvider.deleted, check.DeepEquals, testProvider.created)
+	c.Assert(args.state.Machines, check.HasLen, 0)
+}
+
+func (s *S) TestCreateMachinesBackward(c *check.C) {
+	args := s.newArgs()
+	machines := []*iaas.Machine{{Id: "test-machine-1"}, {Id: "test-machine-2"}}
+	args.state.Machines = append([]*iaas.Machine{{Id: "existing"}}, machines...)
+	createMachines.Backward(action.BWContext{Params: []interface{}{args}, FWResult: machines})
+	c.Assert(testProvider.deleted, check.DeepEquals, machines)
+	c.Assert(args.state.Machines, check.DeepEquals, []*iaas.Machine{{Id: "existing"}})
+	c.Assert(args.undone, check.DeepEquals, []string{"create-machines"})
+}
+
+func (s *S) TestStartComponent(c *check.C) {
+	args := s.newArgs()
+	_, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	a := startComponent(&Component{Name: "redis", Image: "redis:3.0", Ports: []string{"6379"}})
+	c.Assert(a.Name, check.Equals, "start-redis")
+	result, err := a.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	container, err := args.client.InspectContainer(result.(string))
+	c.Assert(err, check.IsNil)
+	c.Assert(container.Name, check.Equals, "redis")
+	c.Assert(args.state.Containers, check.DeepEquals, []ContainerState{{Component: "redis", ID: result.(string)}})
+	c.Assert(container.State.Running, check.Equals, true)
+	a.Backward(action.BWContext{Params: []interface{}{args}, FWResult: result})
+	_, err = args.client.InspectContainer(result.(string))
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+	c.Assert(args.state.Containers, check.HasLen, 0)
+	c.Assert(args.undone, check.DeepEquals, []string{"start-redis"})
+}
+
+func (s *S) TestStartComponentReplacesLeftover(c *check.C) {
+	args := s.newArgs()
+	_, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	a := startComponent(&Component{Name: "redis", Image: "redis:3.0"})
+	first, err := a.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	second, err := a.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(second, check.Not(check.Equals), first)
+	_, err = args.client.InspectContainer(first.(string))
+	c.Assert(err, check.FitsTypeOf, &docker.NoSuchContainer{})
+	c.Assert(args.state.Containers, check.DeepEquals, []ContainerState{{Component: "redis", ID: second.(string)}})
+}
+
+func (s *S) TestCreateAdmin(c *check.C) {
+	args := s.newArgs()
+	_, err := createMachines.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	for _, name := range []string{"mongodb", "tsuru-api"} {
+		_, err = startComponent(&Component{Name: name, Image: "tsuru/" + name}).Forward(action.FWContext{Params: []interface{}{args}})
+		c.Assert(err, check.IsNil)
+	}
+	result, err := createAdmin.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.Equals, "admin@example.com")
+	c.Assert(s.execInputs(), check.DeepEquals, []string{"secret\nsecret\n"})
+	createAdmin.Backward(action.BWContext{Params: []interface{}{args}, FWResult: result})
+	c.Assert(args.undone, check.DeepEquals, []string{"create-admin"})
+	c.Assert(s.execInputs()[1], check.Matches, `(?s)try \{\n  if \(!db.auth\("admin", .*\)\) throw .*;\n  db.getSiblingDB\("tsurudb"\).users.remove\(\{email: "admin@example.com"\}\);\n.*`)
+}
+
+func (s *S) TestResumable(c *check.C) {
+	var forward, backward int
+	a := resumable(&action.Action{
+		Name: "step",
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			forward++
+			return "done", nil
+		},
+		Backward: func(ctx action.BWContext) {
+			backward++
+		},
+	})
+	args := s.newArgs()
+	result, err := a.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(result, check.Equals, "done")
+	state, err := LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Steps, check.DeepEquals, []string{"step"})
+	a.Backward(action.BWContext{Params: []interface{}{args}, FWResult: result})
+	c.Assert(backward, check.Equals, 1)
+	c.Assert(args.state.Steps, check.HasLen, 0)
+	c.Assert(forward, check.Equals, 1)
+}
+
+func (s *S) TestResumableSkipsFinishedStep(c *check.C) {
+	var out bytes.Buffer
+	var forward, backward int
+	a := resumable(&action.Action{
+		Name: "step",
+		Forward: func(ctx action.FWContext) (action.Result, error) {
+			forward++
+			return "done", nil
+		},
+		Backward: func(ctx action.BWContext) {
+			backward++
+		},
+	})
+	args := s.newArgs()
+	args.out = &out
+	args.state.Steps = []string{"step"}
+	result, err := a.Forward(action.FWContext{Params: []interface{}{args}})
+	c.Assert(err, check.IsNil)
+	c.Assert(forward, check.Equals, 0)
+	c.Assert(out.String(), check.Equals, "Skipping step, already done.\n")
+	a.Backward(action.BWContext{Params: []interface{}{args}, FWResult: result})
+	c.Assert(backward, check.Equals, 0)
+	c.Assert(args.state.Steps, check.DeepEquals, []string{"step"})
+}
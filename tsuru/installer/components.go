@@ -0,0 +1,93 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/action"
+)
+
+const (
+	mongoPort    = 27017
+	redisPort    = 6379
+	routerPort   = 80
+	registryPort = 5000
+	gandalfPort  = 8000
+	apiPort      = 8080
+
+	tsuruConfigPath = "/etc/tsuru/tsuru.conf"
+	tsuruDatabase   = "tsurudb"
+)
+
+// Component is a tsuru component that runs as a container in the installed
+// machine.
+type Component struct {
+	Name  string
+	Image string
+	Ports []string
+	Env   []string
+	Cmd   []string
+	Binds []string
+	// Links are the containers linked to this one, as name:alias.
+	Links []string
+	// Files returns the files copied to the container before it is
+	// started, keyed by their path.
+	Files func(m *iaas.Machine) (map[string]string, error)
+	// Setup is run as a separate step after the container is started.
+	Setup *action.Action
+}
+
+// dataDirs returns the directories of the host where the components keep
+// their data: the directory of the installation, followed by the data
+// directories configured outside of it.
+func dataDirs(conf *Config) []string {
+	dirs := []string{conf.dataDir("")}
+	for _, c := range components(conf) {
+		for _, bind := range c.Binds {
+			dir := strings.SplitN(bind, ":", 2)[0]
+			if !strings.HasPrefix(dir, dirs[0]+"/") && !contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+func components(conf *Config) []*Component {
+	comps := mongoComponents(conf)
+	comps = append(comps, redisComponent(conf))
+	if r, ok := routers[conf.Router.Type]; ok {
+		comps = append(comps, r.components(conf)...)
+	}
+	comps = append(comps, registryComponent(conf))
+	comps = append(comps, gandalfComponents(conf)...)
+	comps = append(comps, &Component{
+		Name:  "tsuru-api",
+		Image: "tsuru/api",
+		Ports: []string{fmt.Sprint(apiPort)},
+		Files: func(m *iaas.Machine) (map[string]string, error) {
+			return tsuruFiles(conf, m)
+		},
+	})
+	for _, c := range comps {
+		c.Image = conf.image(c.Name, c.Image)
+	}
+	return comps
+}
+
+func tsuruFiles(conf *Config, m *iaas.Machine) (map[string]string, error) {
+	content, err := tsuruConfig(conf, m)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{tsuruConfigPath: content}, nil
+}
+
+func apiURL(m *iaas.Machine) string {
+	return fmt.Sprintf("http://%s:%d", m.Address, apiPort)
+}
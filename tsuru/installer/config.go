@@ -0,0 +1,416 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+const (
+	defaultName       = "tsuru"
+	defaultRouter     = "hipache"
+	defaultAdminEmail = "admin@example.com"
+)
+
+// Config describes an installation. It's usually loaded from a YAML file
+// with LoadConfig.
+type Config struct {
+	Name       string                     `yaml:"name"`
+	Iaas       IaasConfig                 `yaml:"iaas"`
+	Machines   int                        `yaml:"machines"`
+	Components map[string]ComponentConfig `yaml:"components"`
+	Router     RouterConfig               `yaml:"router"`
+	Domain     string                     `yaml:"domain"`
+	Admin      AdminConfig                `yaml:"admin"`
+	MongoDB    MongoDBConfig              `yaml:"mongodb"`
+	Redis      RedisConfig                `yaml:"redis"`
+	Registry   RegistryConfig             `yaml:"registry"`
+	// iaasSet tells whether iaas.name is in the config file, since the
+	// default iaas is filled in when it isn't.
+	iaasSet bool
+}
+
+type IaasConfig struct {
+	Name   string            `yaml:"name"`
+	Params map[string]string `yaml:"params"`
+}
+
+// ComponentConfig overrides the image used by a component. Version replaces
+// the tag of the image.
+type ComponentConfig struct {
+	Image   string `yaml:"image"`
+	Version string `yaml:"version"`
+}
+
+// RouterConfig selects the router used by tsuru. The password is used by
+// the galeb API and is generated when it isn't set.
+type RouterConfig struct {
+	Type     string `yaml:"type"`
+	Password string `yaml:"password"`
+}
+
+// AdminConfig describes the admin user. SSHKey is the path of the public
+// key registered in gandalf, ~/.ssh/id_rsa.pub by default.
+type AdminConfig struct {
+	Email    string `yaml:"email"`
+	Password string `yaml:"password"`
+	SSHKey   string `yaml:"ssh-key"`
+}
+
+// MongoDBConfig configures the MongoDB used by tsuru. The data is kept in
+// DataDir, in the host. Passwords that aren't set are generated.
+type MongoDBConfig struct {
+	DataDir       string `yaml:"data-dir"`
+	ReplicaSet    bool   `yaml:"replica-set"`
+	AdminPassword string `yaml:"admin-password"`
+	Password      string `yaml:"password"`
+	// keyFile authenticates the members of the replica set to each other.
+	keyFile string
+}
+
+// RedisConfig configures the Redis used by the router and by the pub/sub of
+// tsuru. The data is kept in DataDir, in the host. MaxMemory is the
+// maxmemory of Redis, like 256mb, and the password is generated when it
+// isn't set.
+type RedisConfig struct {
+	DataDir   string `yaml:"data-dir"`
+	Password  string `yaml:"password"`
+	MaxMemory string `yaml:"max-memory"`
+}
+
+// RegistryConfig configures the Docker registry. The images are kept in
+// DataDir, in the host. Cert and Key are the paths of the certificate used
+// by the registry, a self-signed one is generated when they aren't set.
+// Basic auth is enabled when Username is set, and the password is generated
+// when it isn't set.
+type RegistryConfig struct {
+	DataDir  string `yaml:"data-dir"`
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// cert and key replace the certificate and its key, in PEM.
+	cert string
+	key  string
+}
+
+// ConfigError lists the problems found in a configuration file.
+type ConfigError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config file %s:\n  %s", e.Path, strings.Join(e.Problems, "\n  "))
+}
+
+// DefaultConfig returns the configuration used when no file is given.
+func DefaultConfig() *Config {
+	conf := &Config{}
+	conf.setDefaults()
+	return conf
+}
+
+// LoadConfig reads the configuration from the given YAML file. Unknown keys
+// and values of the wrong type are reported with their line numbers.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(path, data)
+}
+
+func parseConfig(path string, data []byte) (*Config, error) {
+	var raw map[string]interface{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	v := &configValidator{lines: keyLines(data)}
+	v.check(raw, reflect.TypeOf(Config{}), "")
+	var conf Config
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	v.checkValues(&conf, raw)
+	if len(v.problems) > 0 {
+		return nil, &ConfigError{Path: path, Problems: v.sortedProblems()}
+	}
+	conf.iaasSet = conf.Iaas.Name != ""
+	conf.setDefaults()
+	return &conf, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.Name == "" {
+		c.Name = defaultName
+	}
+	if c.Iaas.Name == "" {
+		c.Iaas.Name = defaultIaas
+	}
+	if c.Machines == 0 {
+		c.Machines = 1
+	}
+	if c.Router.Type == "" {
+		c.Router.Type = defaultRouter
+	}
+	if c.Admin.Email == "" {
+		c.Admin.Email = defaultAdminEmail
+	}
+	if c.MongoDB.DataDir == "" {
+		c.MongoDB.DataDir = c.dataDir("mongodb")
+	}
+	if c.Redis.DataDir == "" {
+		c.Redis.DataDir = c.dataDir("redis")
+	}
+	if c.Registry.DataDir == "" {
+		c.Registry.DataDir = c.dataDir("registry")
+	}
+}
+
+// dataDir returns the directory of the machines where the named component
+// keeps its data, under the directory of the installation. It returns the
+// directory of the installation when component is empty.
+func (c *Config) dataDir(component string) string {
+	return path.Join("/var/lib/yati", c.Name, component)
+}
+
+// image returns the image used by the named component, applying the
+// overrides from the configuration to the given default image.
+func (c *Config) image(name, image string) string {
+	override, ok := c.Components[name]
+	if !ok {
+		return image
+	}
+	repository, tag := parseImage(image)
+	if override.Image != "" {
+		repository, tag = parseImage(override.Image)
+	}
+	if override.Version != "" {
+		tag = override.Version
+	}
+	return repository + ":" + tag
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var memoryRegexp = regexp.MustCompile(`^(?i)[0-9]+([kmg]b?)?$`)
+
+var keyRegexp = regexp.MustCompile(`^(\s*)([^\s#'"][^:#]*?|"[^"]*"|'[^']*')\s*:(\s|$)`)
+
+// keyLines maps the path of each key in a YAML document, like
+// "iaas.params.driver", to the line where it's defined. Only block mappings
+// are considered.
+func keyLines(data []byte) map[string]int {
+	type key struct {
+		indent int
+		name   string
+	}
+	lines := make(map[string]int)
+	var stack []key
+	for i, line := range strings.Split(string(data), "\n") {
+		match := keyRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		indent := len(match[1])
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, key{indent: indent, name: strings.Trim(match[2], `"'`)})
+		var names []string
+		for _, k := range stack {
+			names = append(names, k.name)
+		}
+		path := strings.Join(names, ".")
+		if _, ok := lines[path]; !ok {
+			lines[path] = i + 1
+		}
+	}
+	return lines
+}
+
+type configProblem struct {
+	line int
+	msg  string
+}
+
+type configValidator struct {
+	lines    map[string]int
+	problems []configProblem
+}
+
+func (v *configValidator) addProblem(path, format string, a ...interface{}) {
+	problem := configProblem{msg: fmt.Sprintf(format, a...)}
+	for p := path; p != ""; {
+		if line, ok := v.lines[p]; ok {
+			problem.line = line
+			problem.msg = fmt.Sprintf("line %d: %s", line, problem.msg)
+			break
+		}
+		i := strings.LastIndex(p, ".")
+		if i < 0 {
+			break
+		}
+		p = p[:i]
+	}
+	v.problems = append(v.problems, problem)
+}
+
+// sortedProblems returns the problems in the order they appear in the file.
+func (v *configValidator) sortedProblems() []string {
+	sort.Stable(problemsByLine(v.problems))
+	result := make([]string, len(v.problems))
+	for i, p := range v.problems {
+		result[i] = p.msg
+	}
+	return result
+}
+
+type problemsByLine []configProblem
+
+func (p problemsByLine) Len() int           { return len(p) }
+func (p problemsByLine) Less(i, j int) bool { return p[i].line < p[j].line }
+func (p problemsByLine) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// check walks the decoded document comparing it with the type it's
+// going to be unmarshaled into.
+func (v *configValidator) check(value interface{}, t reflect.Type, path string) {
+	if value == nil {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := toMap(value)
+		if !ok {
+			v.addProblem(path, "%s must be a mapping", path)
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			fields[strings.Split(field.Tag.Get("yaml"), ",")[0]] = field.Type
+		}
+		for _, key := range sortedKeys(m) {
+			fieldType, ok := fields[key]
+			if !ok {
+				v.addProblem(joinPath(path, key), "unknown key %q", joinPath(path, key))
+				continue
+			}
+			v.check(m[key], fieldType, joinPath(path, key))
+		}
+	case reflect.Map:
+		m, ok := toMap(value)
+		if !ok {
+			v.addProblem(path, "%s must be a mapping", path)
+			return
+		}
+		for _, key := range sortedKeys(m) {
+			v.check(m[key], t.Elem(), joinPath(path, key))
+		}
+	case reflect.String:
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			v.addProblem(path, "%s must be a string", path)
+		}
+	case reflect.Int:
+		if _, ok := value.(int); !ok {
+			v.addProblem(path, "%s must be an integer, got %q", path, fmt.Sprint(value))
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			v.addProblem(path, "%s must be a boolean, got %q", path, fmt.Sprint(value))
+		}
+	}
+}
+
+// checkValues validates the values of a decoded configuration. The raw
+// document tells a key set to zero apart from one that's missing.
+func (v *configValidator) checkValues(c *Config, raw map[string]interface{}) {
+	if c.Name != "" && !nameRegexp.MatchString(c.Name) {
+		v.addProblem("name", "invalid name %q, it must contain only letters, numbers, dashes and underscores", c.Name)
+	}
+	if n, ok := raw["machines"].(int); ok && n <= 0 {
+		v.addProblem("machines", "machines must be greater than zero")
+	}
+	if c.Router.Type != "" && !contains(routerTypes, c.Router.Type) {
+		v.addProblem("router.type", "unknown router type %q, available types: %s", c.Router.Type, strings.Join(routerTypes, ", "))
+	}
+	if c.Redis.MaxMemory != "" && !memoryRegexp.MatchString(c.Redis.MaxMemory) {
+		v.addProblem("redis.max-memory", "invalid redis.max-memory %q, it must be a size like 256mb", c.Redis.MaxMemory)
+	}
+	if (c.Registry.Cert == "") != (c.Registry.Key == "") {
+		v.addProblem("registry", "registry.cert and registry.key must be set together")
+	}
+	var names []string
+	for _, t := range routerTypes {
+		conf := DefaultConfig()
+		conf.Router.Type = t
+		for _, comp := range components(conf) {
+			if !contains(names, comp.Name) {
+				names = append(names, comp.Name)
+			}
+		}
+	}
+	var unknown []string
+	for name := range c.Components {
+		if !contains(names, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		v.addProblem("components."+name, "unknown component %q, available components: %s", name, strings.Join(names, ", "))
+	}
+}
+
+func toMap(value interface{}) (map[string]interface{}, bool) {
+	switch m := value.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			result[fmt.Sprint(k)] = v
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
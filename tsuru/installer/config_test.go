@@ -0,0 +1,197 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestDefaultConfig(c *check.C) {
+	conf := DefaultConfig()
+	c.Assert(conf.Name, check.Equals, "tsuru")
+	c.Assert(conf.Iaas.Name, check.Equals, "docker-machine")
+	c.Assert(conf.Machines, check.Equals, 1)
+	c.Assert(conf.Router.Type, check.Equals, "hipache")
+	c.Assert(conf.Admin.Email, check.Equals, "admin@example.com")
+	c.Assert(conf.MongoDB.DataDir, check.Equals, "/var/lib/yati/tsuru/mongodb")
+	c.Assert(conf.Redis.DataDir, check.Equals, "/var/lib/yati/tsuru/redis")
+	c.Assert(conf.Registry.DataDir, check.Equals, "/var/lib/yati/tsuru/registry")
+}
+
+func (s *S) TestDataDirs(c *check.C) {
+	conf := DefaultConfig()
+	conf.MongoDB.DataDir = "/mnt/mongodb"
+	c.Assert(dataDirs(conf), check.DeepEquals, []string{"/var/lib/yati/tsuru", "/mnt/mongodb"})
+}
+
+func (s *S) TestLoadConfig(c *check.C) {
+	data := `# staging environment
+name: staging
+iaas:
+  name: docker-machine
+  params:
+    driver: virtualbox
+    virtualbox-memory: 2048
+machines: 2
+components:
+  mongodb:
+    version: "3.0"
+  tsuru-api:
+    image: tsuru/api:v1
+router:
+  type: hipache
+domain: tsuru.example.com
+admin:
+  email: root@example.com
+  password: s3cr3t
+mongodb:
+  replica-set: true
+  password: mongo-s3cr3t
+redis:
+  max-memory: 256mb
+`
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	defer os.Remove(f.Name())
+	f.WriteString(data)
+	f.Close()
+	conf, err := LoadConfig(f.Name())
+	c.Assert(err, check.IsNil)
+	expected := &Config{
+		Name: "staging",
+		Iaas: IaasConfig{
+			Name:   "docker-machine",
+			Params: map[string]string{"driver": "virtualbox", "virtualbox-memory": "2048"},
+		},
+		Machines: 2,
+		Components: map[string]ComponentConfig{
+			"mongodb":   {Version: "3.0"},
+			"tsuru-api": {Image: "tsuru/api:v1"},
+		},
+		Router: RouterConfig{Type: "hipache"},
+		Domain: "tsuru.example.com",
+		Admin:  AdminConfig{Email: "root@example.com", Password: "s3cr3t"},
+		MongoDB: MongoDBConfig{
+			DataDir:    "/var/lib/yati/staging/mongodb",
+			ReplicaSet: true,
+			Password:   "mongo-s3cr3t",
+		},
+		Redis: RedisConfig{
+			DataDir:   "/var/lib/yati/staging/redis",
+			MaxMemory: "256mb",
+		},
+		Registry: RegistryConfig{DataDir: "/var/lib/yati/staging/registry"},
+		iaasSet:  true,
+	}
+	c.Assert(conf, check.DeepEquals, expected)
+}
+
+func (s *S) TestLoadConfigNotFound(c *check.C) {
+	_, err := LoadConfig("/tmp/yati-not-found.yml")
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *S) TestParseConfigDefaults(c *check.C) {
+	conf, err := parseConfig("yati.yml", []byte("domain: example.com\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Domain, check.Equals, "example.com")
+	c.Assert(conf.Iaas.Name, check.Equals, "docker-machine")
+	c.Assert(conf.Machines, check.Equals, 1)
+}
+
+func (s *S) TestParseConfigSyntaxError(c *check.C) {
+	_, err := parseConfig("yati.yml", []byte("iaas:\n  name: [docker\n"))
+	c.Assert(err, check.ErrorMatches, `invalid config file yati.yml: YAML error: line 2: .*`)
+}
+
+func (s *S) TestParseConfigUnknownKeysAndBadTypes(c *check.C) {
+	data := `iaas:
+  name: docker-machine
+  provider: ec2
+machines: two
+components:
+  mongodb:
+    tag: "3.0"
+  mysql:
+    image: mysql
+router:
+  type: nginx
+admin: root
+`
+	_, err := parseConfig("yati.yml", []byte(data))
+	c.Assert(err, check.FitsTypeOf, &ConfigError{})
+	expected := []string{
+		`line 3: unknown key "iaas.provider"`,
+		`line 4: machines must be an integer, got "two"`,
+		`line 7: unknown key "components.mongodb.tag"`,
+		`line 8: unknown component "mysql", available components: mongodb, redis, hipache, registry, archive-server, gandalf, tsuru-api, etcd, vulcand, galeb`,
+		`line 11: unknown router type "nginx", available types: hipache, vulcand, galeb`,
+		`line 12: admin must be a mapping`,
+	}
+	c.Assert(err.(*ConfigError).Problems, check.DeepEquals, expected)
+	c.Assert(err, check.ErrorMatches, `(?s)invalid config file yati.yml:\n  line 3: unknown key "iaas.provider"\n  line 4: .*`)
+}
+
+func (s *S) TestParseConfigInvalidValues(c *check.C) {
+	data := `machines: -1
+name: my/env
+components:
+  mysql:
+    image: mysql
+router:
+  type: nginx
+redis:
+  max-memory: lots
+`
+	_, err := parseConfig("yati.yml", []byte(data))
+	c.Assert(err, check.FitsTypeOf, &ConfigError{})
+	expected := []string{
+		`line 1: machines must be greater than zero`,
+		`line 2: invalid name "my/env", it must contain only letters, numbers, dashes and underscores`,
+		`line 4: unknown component "mysql", available components: mongodb, redis, hipache, registry, archive-server, gandalf, tsuru-api, etcd, vulcand, galeb`,
+		`line 7: unknown router type "nginx", available types: hipache, vulcand, galeb`,
+		`line 9: invalid redis.max-memory "lots", it must be a size like 256mb`,
+	}
+	c.Assert(err.(*ConfigError).Problems, check.DeepEquals, expected)
+}
+
+func (s *S) TestParseConfigZeroMachines(c *check.C) {
+	_, err := parseConfig("yati.yml", []byte("name: tsuru\nmachines: 0\n"))
+	c.Assert(err, check.FitsTypeOf, &ConfigError{})
+	c.Assert(err.(*ConfigError).Problems, check.DeepEquals, []string{"line 2: machines must be greater than zero"})
+}
+
+func (s *S) TestKeyLines(c *check.C) {
+	data := `# comment
+iaas:
+  name: ec2
+  params:
+    "region": us-east-1
+machines: 1
+`
+	expected := map[string]int{
+		"iaas":               2,
+		"iaas.name":          3,
+		"iaas.params":        4,
+		"iaas.params.region": 5,
+		"machines":           6,
+	}
+	c.Assert(keyLines([]byte(data)), check.DeepEquals, expected)
+}
+
+func (s *S) TestConfigImage(c *check.C) {
+	conf := &Config{Components: map[string]ComponentConfig{
+		"mongodb":   {Version: "3.0"},
+		"tsuru-api": {Image: "localhost:5000/tsuru/api"},
+		"redis":     {Image: "myredis:2.8", Version: "3.0"},
+	}}
+	c.Assert(conf.image("mongodb", "mongo:3.2"), check.Equals, "mongo:3.0")
+	c.Assert(conf.image("tsuru-api", "tsuru/api"), check.Equals, "localhost:5000/tsuru/api:latest")
+	c.Assert(conf.image("redis", "redis:3.0"), check.Equals, "myredis:3.0")
+	c.Assert(conf.image("gandalf", "tsuru/gandalf"), check.Equals, "tsuru/gandalf")
+}
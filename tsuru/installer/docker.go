@@ -0,0 +1,261 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const defaultDockerPort = 2375
+
+func dockerEndpoint(m *iaas.Machine) string {
+	if m.Endpoint != "" {
+		return m.Endpoint
+	}
+	port := m.Port
+	if port == 0 {
+		port = defaultDockerPort
+	}
+	scheme := "http"
+	if m.ClientCert != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, m.Address, port)
+}
+
+// dockerClient returns a client to the Docker daemon of the machine, using
+// TLS when the machine has certificates.
+func dockerClient(m *iaas.Machine) (*docker.Client, error) {
+	if m.ClientCert != "" {
+		client, err := docker.NewTLSClient(dockerEndpoint(m), m.ClientCert, m.ClientKey, m.CaCert)
+		if err != nil {
+			return nil, err
+		}
+		client.TLSConfig.ServerName = m.TLSServerName
+		return client, nil
+	}
+	return docker.NewClient(dockerEndpoint(m))
+}
+
+// parseImage splits an image name in repository and tag, defaulting the tag
+// to latest.
+func parseImage(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, "latest"
+	}
+	return image[:i], image[i+1:]
+}
+
+// parsePort splits a port in the form [host:]container.
+func parsePort(port string) (string, string) {
+	parts := strings.SplitN(port, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// start creates and starts the component container in the given machine,
+// returning the container id.
+func (c *Component) start(client *docker.Client, m *iaas.Machine) (string, error) {
+	repository, tag := parseImage(c.Image)
+	err := client.PullImage(docker.PullImageOptions{Repository: repository, Tag: tag}, docker.AuthConfiguration{})
+	if err != nil {
+		return "", err
+	}
+	exposed := make(map[docker.Port]struct{})
+	bindings := make(map[docker.Port][]docker.PortBinding)
+	for _, p := range c.Ports {
+		host, container := parsePort(p)
+		port := docker.Port(container + "/tcp")
+		exposed[port] = struct{}{}
+		bindings[port] = []docker.PortBinding{{HostIP: "0.0.0.0", HostPort: host}}
+	}
+	hostConfig := &docker.HostConfig{
+		PortBindings:  bindings,
+		Binds:         c.Binds,
+		Links:         c.Links,
+		RestartPolicy: docker.AlwaysRestart(),
+	}
+	opts := docker.CreateContainerOptions{
+		Name: c.Name,
+		Config: &docker.Config{
+			Image:        repository + ":" + tag,
+			Env:          c.Env,
+			Cmd:          c.Cmd,
+			ExposedPorts: exposed,
+		},
+		HostConfig: hostConfig,
+	}
+	container, err := client.CreateContainer(opts)
+	if err != nil {
+		return "", err
+	}
+	if c.Files != nil {
+		var files map[string]string
+		files, err = c.Files(m)
+		if err == nil {
+			err = uploadFiles(client, container.ID, files)
+		}
+		if err != nil {
+			removeContainer(client, container.ID)
+			return "", err
+		}
+	}
+	err = client.StartContainer(container.ID, hostConfig)
+	if err != nil {
+		removeContainer(client, container.ID)
+		return "", err
+	}
+	return container.ID, nil
+}
+
+// helperContainer creates a busybox container running the command, with the
+// given directories of the machine bound, used to change files of the
+// machine.
+func helperContainer(client *docker.Client, binds []string, cmd ...string) (string, error) {
+	err := client.PullImage(docker.PullImageOptions{Repository: "busybox", Tag: "latest"}, docker.AuthConfiguration{})
+	if err != nil {
+		return "", err
+	}
+	container, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config:     &docker.Config{Image: "busybox:latest", Cmd: cmd},
+		HostConfig: &docker.HostConfig{Binds: binds},
+	})
+	if err != nil {
+		return "", err
+	}
+	return container.ID, nil
+}
+
+// runHelper runs the command in a helper container that only runs while the
+// command does, with the given directories of the machine bound.
+func runHelper(client *docker.Client, binds []string, cmd []string) error {
+	id, err := helperContainer(client, binds, "sleep", "60")
+	if err != nil {
+		return err
+	}
+	defer removeContainer(client, id)
+	err = client.StartContainer(id, &docker.HostConfig{Binds: binds})
+	if err != nil {
+		return err
+	}
+	return execInContainer(client, id, cmd, "")
+}
+
+// removeDataDirs removes the directories from the machine. Each directory is
+// removed through a bind of its parent, since a bound directory can't be
+// removed from inside the container. Named volumes and the root directory
+// are left alone.
+func removeDataDirs(client *docker.Client, dirs []string) error {
+	var binds []string
+	cmd := []string{"rm", "-rf"}
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		if !path.IsAbs(dir) || dir == "/" {
+			continue
+		}
+		mount := fmt.Sprintf("/data/%d", len(binds))
+		binds = append(binds, path.Dir(dir)+":"+mount)
+		cmd = append(cmd, path.Join(mount, path.Base(dir)))
+	}
+	if len(binds) == 0 {
+		return nil
+	}
+	return runHelper(client, binds, cmd)
+}
+
+// execInContainer runs the command in the given container, writing input to
+// its stdin.
+func execInContainer(client *docker.Client, id string, cmd []string, input string) error {
+	_, err := execOutput(client, id, cmd, input)
+	return err
+}
+
+// execOutput runs the command in the container, returning its output.
+func execOutput(client *docker.Client, id string, cmd []string, input string) (string, error) {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    id,
+		Cmd:          cmd,
+		AttachStdin:  input != "",
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	err = client.StartExec(exec.ID, docker.StartExecOptions{
+		InputStream:  strings.NewReader(input),
+		OutputStream: &stdout,
+		ErrorStream:  &stderr,
+	})
+	if err != nil {
+		return "", err
+	}
+	result, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return "", err
+	}
+	if result.ExitCode != 0 {
+		return "", fmt.Errorf("%q exited with status %d: %s", strings.Join(cmd, " "), result.ExitCode, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+func removeContainer(client *docker.Client, id string) error {
+	return client.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true, RemoveVolumes: true})
+}
+
+func uploadFiles(client *docker.Client, id string, files map[string]string) error {
+	archive, err := tarFiles(files)
+	if err != nil {
+		return err
+	}
+	return client.UploadToContainer(id, docker.UploadToContainerOptions{
+		InputStream: archive,
+		Path:        "/",
+	})
+}
+
+func tarFiles(files map[string]string) (*bytes.Buffer, error) {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, path := range paths {
+		content := files[path]
+		header := &tar.Header{
+			Name: strings.TrimPrefix(path, "/"),
+			Mode: 0644,
+			Size: int64(len(content)),
+		}
+		err := w.WriteHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/go-gandalfclient"
+	"github.com/tsuru/tsuru/action"
+	"github.com/tsuru/tsuru/cmd"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v1"
+)
+
+const (
+	gandalfSSHPort      = 2222
+	archiveReadPort     = 3232
+	archiveWritePort    = 3131
+	gandalfConfigPath   = "/etc/gandalf.conf"
+	gandalfReposPath    = "/var/lib/gandalf/repositories"
+	gandalfTemplatePath = "/home/git/bare-template"
+	gandalfHookPath     = gandalfTemplatePath + "/hooks/pre-receive"
+	gandalfTokenPath    = "/home/git/.tsuru_token"
+	archivesPath        = "/var/lib/archive-server"
+
+	// sshKeyName is the name of the admin key in gandalf.
+	sshKeyName = "yati"
+)
+
+// gandalfStartScript makes the pre-receive hook executable, since the files
+// are copied with mode 0644, and starts sshd and the gandalf API.
+const gandalfStartScript = `chmod 755 %[1]s && /usr/sbin/sshd && exec gandalf-webserver -config %[2]s`
+
+// gandalfHook is the pre-receive hook of the repositories. It asks the
+// archive server for an archive of the pushed commit and deploys it with the
+// tsuru API, using the token generated on install.
+const gandalfHook = `#!/bin/bash -el
+
+ARCHIVE_SERVER_READ=%[1]s
+ARCHIVE_SERVER_WRITE=%[2]s
+TSURU_HOST=%[3]s
+TSURU_TOKEN=$(cat %[4]s)
+
+while read oldrev newrev refname; do
+  if echo $refname | grep -q /master$; then
+    COMMIT=$newrev
+  fi
+done
+if [ -z "$COMMIT" ]; then
+  echo "ERROR: please push to master"
+  exit 3
+fi
+app_name=$(basename $(pwd) .git)
+response=$(curl -sS -XPOST -d "path=${PWD}&refid=${COMMIT}" ${ARCHIVE_SERVER_WRITE}/)
+archive_id=$(echo $response | sed 's/^{"id":"\(.*\)"}$/\1/')
+archive_url="${ARCHIVE_SERVER_READ}/?id=${archive_id}"
+curl -sS -N --max-time 1800 -H "Authorization: bearer ${TSURU_TOKEN}" \
+  -d "archive-url=${archive_url}&commit=${COMMIT}" \
+  ${TSURU_HOST}/apps/${app_name}/repository/clone | tee /tmp/deploy-${app_name}.log
+tail -1 /tmp/deploy-${app_name}.log | grep -q "^OK$"
+`
+
+// gandalfComponents returns gandalf and the archive server used by its
+// hook. The repositories are kept in a directory of the host, shared by
+// both containers.
+func gandalfComponents(conf *Config) []*Component {
+	repos := conf.dataDir("gandalf") + ":" + gandalfReposPath
+	return []*Component{
+		{
+			Name:  "archive-server",
+			Image: "tsuru/archive-server",
+			Ports: []string{fmt.Sprint(archiveReadPort)},
+			Cmd: []string{
+				"archive-server", "-dir", archivesPath,
+				"-read-http", fmt.Sprintf("0.0.0.0:%d", archiveReadPort),
+				"-write-http", fmt.Sprintf("0.0.0.0:%d", archiveWritePort),
+			},
+			Binds: []string{repos},
+		},
+		{
+			Name:  "gandalf",
+			Image: "tsuru/gandalf",
+			Ports: []string{fmt.Sprint(gandalfPort), fmt.Sprintf("%d:22", gandalfSSHPort)},
+			Cmd:   []string{"sh", "-c", fmt.Sprintf(gandalfStartScript, gandalfHookPath, gandalfConfigPath)},
+			Binds: []string{repos},
+			Links: []string{"archive-server:archive-server"},
+			Files: func(m *iaas.Machine) (map[string]string, error) {
+				return gandalfFiles(conf, m)
+			},
+		},
+	}
+}
+
+func gandalfFiles(c *Config, m *iaas.Machine) (map[string]string, error) {
+	conf := map[string]interface{}{
+		"bind":           fmt.Sprintf("0.0.0.0:%d", gandalfPort),
+		"host":           m.Address,
+		"readwrite-host": m.Address,
+		"uid":            "git",
+		"database": map[string]interface{}{
+			"url":  mongoURL(c, m),
+			"name": "gandalf",
+		},
+		"git": map[string]interface{}{
+			"bare": map[string]interface{}{
+				"location": gandalfReposPath,
+				"template": gandalfTemplatePath,
+			},
+			// The remotes use the port of sshd published in the
+			// machine. Gandalf reads the port as a string.
+			"ssh": map[string]interface{}{
+				"use":  true,
+				"port": fmt.Sprint(gandalfSSHPort),
+			},
+		},
+	}
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	hook := fmt.Sprintf(gandalfHook,
+		fmt.Sprintf("http://%s:%d", m.Address, archiveReadPort),
+		fmt.Sprintf("http://archive-server:%d", archiveWritePort),
+		apiURL(m), gandalfTokenPath)
+	return map[string]string{
+		gandalfConfigPath: string(out),
+		gandalfHookPath:   hook,
+	}, nil
+}
+
+func gandalfURL(m *iaas.Machine) string {
+	return fmt.Sprintf("http://%s:%d", m.Address, gandalfPort)
+}
+
+// sshKey returns the public key registered for the admin user, read from
+// the path in the configuration or from ~/.ssh/id_rsa.pub. It must be in the
+// authorized_keys format. There's no key when the path isn't set and the
+// default file doesn't exist.
+func sshKey(c *Config) (string, error) {
+	path := c.Admin.SSHKey
+	if path == "" {
+		path = cmd.JoinWithUserDir(".ssh", "id_rsa.pub")
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return "", nil
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read SSH key: %s", err)
+	}
+	key := strings.TrimSpace(string(data))
+	_, _, _, _, err = ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH key %s: %s", path, err)
+	}
+	return key, nil
+}
+
+// addSSHKey adds the public key to the gandalf user, creating the user when
+// it doesn't exist.
+func addSSHKey(gandalfURL, user, key string) error {
+	client := gandalf.Client{Endpoint: gandalfURL}
+	keys := map[string]string{sshKeyName: key}
+	err := client.AddKey(user, keys)
+	if e, ok := err.(*gandalf.HTTPError); ok {
+		switch e.Code {
+		case http.StatusNotFound:
+			_, err = client.NewUser(user, keys)
+		case http.StatusConflict:
+			err = nil
+		}
+	}
+	return err
+}
+
+// setupGandalf gives the hook of the repositories a token of the tsuru API
+// and registers the SSH key of the admin, so apps can be deployed with git
+// push. It's the last step, so it's never rolled back after succeeding, and
+// registering the key, which could fail, comes last: a failure leaves only
+// the token, which goes away with the gandalf container.
+var setupGandalf = action.Action{
+	Name: "setup-gandalf",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		fmt.Fprintf(args.out, "Setting up gandalf...\n")
+		command := []string{"tsurud", "token", "--config", tsuruConfigPath}
+		token, err := execOutput(args.client, args.containerID("tsuru-api"), command, "")
+		if err != nil {
+			return nil, fmt.Errorf("unable to create tsuru token: %s", err)
+		}
+		files := map[string]string{gandalfTokenPath: strings.TrimSpace(token) + "\n"}
+		err = uploadFiles(args.client, args.containerID("gandalf"), files)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up gandalf: %s", err)
+		}
+		key, err := sshKey(args.config)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			fmt.Fprintf(args.out, "No SSH key found, skipping its registration.\n")
+			return nil, nil
+		}
+		err = args.hooks.AddSSHKey(gandalfURL(args.machine()), args.config.Admin.Email, key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to register SSH key: %s", err)
+		}
+		return nil, nil
+	},
+	MinParams: 1,
+}
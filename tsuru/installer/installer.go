@@ -0,0 +1,242 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package installer provisions a machine through an IaaS and starts the tsuru
+// components on it.
+package installer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/action"
+)
+
+const defaultIaas = "docker-machine"
+
+var errNoAddress = errors.New("the created machine has no address")
+
+type Installer struct {
+	Config *Config
+	Out    io.Writer
+	Hooks
+}
+
+// Hooks are the calls made by the installer to the tsuru components once
+// they're running. The nil ones default to the real calls, so only tests,
+// where the components run in a fake Docker server, set them.
+type Hooks struct {
+	PingMongoDB func(mongoURL string) error
+	PingRedis   func(redisURL string) error
+	CheckRoute  func(conf *Config, m *iaas.Machine) error
+	AddSSHKey   func(gandalfURL, user, key string) error
+	AddNodes    func(apiURL string, admin AdminConfig, addresses []string) error
+	RemoveNodes func(apiURL string, admin AdminConfig, addresses []string) error
+}
+
+func (h Hooks) withDefaults() Hooks {
+	if h.PingMongoDB == nil {
+		h.PingMongoDB = pingMongoDB
+	}
+	if h.PingRedis == nil {
+		h.PingRedis = pingRedis
+	}
+	if h.CheckRoute == nil {
+		h.CheckRoute = checkRoute
+	}
+	if h.AddSSHKey == nil {
+		h.AddSSHKey = addSSHKey
+	}
+	if h.AddNodes == nil {
+		h.AddNodes = addNodes
+	}
+	if h.RemoveNodes == nil {
+		h.RemoveNodes = removeNodes
+	}
+	return h
+}
+
+// Installation is the result of a successful install. The tsuru components
+// run in the first machine.
+type Installation struct {
+	Name     string
+	Machines []*iaas.Machine
+	APIURL   string
+	Admin    AdminConfig
+}
+
+// InstallError is returned when an install step fails. Undone holds the
+// steps that were rolled back, in the order they were undone.
+type InstallError struct {
+	Err    error
+	Undone []string
+}
+
+func (e *InstallError) Error() string {
+	return e.Err.Error()
+}
+
+// Install creates the machines and starts the tsuru components on them. The
+// progress is recorded in the installation state, so running it again after
+// an interruption resumes from the first unfinished step.
+func (i *Installer) Install() (*Installation, error) {
+	out, conf, provider, err := i.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if errs := problems(conf); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	actions := []*action.Action{resumable(&createMachines)}
+	for _, c := range components(conf) {
+		actions = append(actions, resumable(startComponent(c)))
+		if c.Setup != nil {
+			actions = append(actions, resumable(c.Setup))
+		}
+	}
+	actions = append(actions, resumable(&checkRouter), resumable(&createAdmin), resumable(&registerNodes), resumable(&setupGandalf))
+	state, err := loadOrCreateState(conf, actions)
+	if err != nil {
+		return nil, err
+	}
+	err = fillSecrets(conf, state)
+	if err != nil {
+		return nil, err
+	}
+	args := &installArgs{
+		out:      out,
+		config:   conf,
+		provider: provider,
+		state:    state,
+		hooks:    i.Hooks.withDefaults(),
+	}
+	if len(state.Machines) > 0 {
+		fmt.Fprintf(out, "Resuming installation %q...\n", conf.Name)
+		args.client, err = dockerClient(args.machine())
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = action.NewPipeline(actions...).Execute(args)
+	if err != nil {
+		if len(state.Machines) == 0 {
+			state.Remove()
+		} else {
+			state.Save()
+		}
+		return nil, &InstallError{Err: err, Undone: args.undone}
+	}
+	return &Installation{
+		Name:     conf.Name,
+		Machines: state.Machines,
+		APIURL:   state.APIURL,
+		Admin:    conf.Admin,
+	}, nil
+}
+
+// resolve returns the output, the configuration with its defaults and the
+// provider used by the installer, with the iaas params validated.
+func (i *Installer) resolve() (io.Writer, *Config, iaas.Iaas, error) {
+	out := i.Out
+	if out == nil {
+		out = ioutil.Discard
+	}
+	conf := &Config{}
+	if i.Config != nil {
+		*conf = *i.Config
+	}
+	conf.setDefaults()
+	provider, err := iaas.Get(conf.Iaas.Name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	conf.Iaas.Params, err = iaas.ValidateParams(conf.Iaas.Name, conf.Iaas.Params)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out, conf, provider, nil
+}
+
+// problems returns what would make the install fail after the machines are
+// created: a provider whose machines don't run Docker and an invalid SSH key
+// of the admin. Install fails on them before creating anything, and Plan
+// lists them.
+func problems(conf *Config) []error {
+	var errs []error
+	err := iaas.CheckDocker(conf.Iaas.Name, conf.Iaas.Params)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = sshKey(conf)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// fillSecrets sets the passwords missing from the configuration to the ones
+// generated for the installation.
+func fillSecrets(conf *Config, state *State) error {
+	secrets := map[string]*string{
+		"admin-password":         &conf.Admin.Password,
+		"mongodb-admin-password": &conf.MongoDB.AdminPassword,
+		"mongodb-password":       &conf.MongoDB.Password,
+		"mongodb-keyfile":        &conf.MongoDB.keyFile,
+		"redis-password":         &conf.Redis.Password,
+	}
+	if conf.Router.Type == "galeb" {
+		secrets["router-password"] = &conf.Router.Password
+	}
+	if conf.Registry.Username != "" {
+		secrets["registry-password"] = &conf.Registry.Password
+	}
+	for name, value := range secrets {
+		if *value != "" {
+			continue
+		}
+		var err error
+		*value, err = state.secret(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadOrCreateState returns the state of an interrupted install with the
+// same name, or a new state if there's none.
+func loadOrCreateState(conf *Config, actions []*action.Action) (*State, error) {
+	_, err := os.Stat(statePath(conf.Name))
+	if os.IsNotExist(err) {
+		return &State{Name: conf.Name, Iaas: conf.Iaas.Name, DataDirs: dataDirs(conf)}, nil
+	}
+	state, err := LoadState(conf.Name)
+	if err != nil {
+		return nil, err
+	}
+	if state.Iaas != conf.Iaas.Name {
+		return nil, fmt.Errorf("installation %q was created using iaas %q, not %q", conf.Name, state.Iaas, conf.Iaas.Name)
+	}
+	for _, a := range actions {
+		if !state.finished(a.Name) {
+			return state, nil
+		}
+	}
+	return nil, fmt.Errorf("installation %q is already installed, uninstall it first", conf.Name)
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/fake"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestInstall(c *check.C) {
+	var out bytes.Buffer
+	i := s.installer(testConfig())
+	i.Out = &out
+	installation, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(installation.Machines, check.HasLen, 1)
+	c.Assert(installation.Machines[0].Id, check.Equals, "test-machine-1")
+	c.Assert(installation.Admin, check.DeepEquals, AdminConfig{Email: "admin@example.com", Password: "secret"})
+	c.Assert(installation.APIURL, check.Equals, fmt.Sprintf("http://%s:8080", testProvider.address))
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	var names []string
+	for _, container := range containers {
+		names = append(names, container.Names...)
+	}
+	c.Assert(names, check.DeepEquals, []string{"/mongodb", "/redis", "/hipache", "/registry", "/archive-server", "/gandalf", "/tsuru-api"})
+	c.Assert(s.uploads(), check.HasLen, 6)
+	c.Assert(out.String(), check.Matches, `(?s)Creating machine 1/1 using "test-iaas".*Starting tsuru-api.*Creating admin user admin@example.com.*`)
+}
+
+func (s *S) TestInstallMultipleMachines(c *check.C) {
+	conf := testConfig()
+	conf.Machines = 3
+	i := s.installer(conf)
+	installation, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(installation.Machines, check.DeepEquals, testProvider.created)
+	c.Assert(installation.Machines, check.HasLen, 3)
+}
+
+func (s *S) TestInstallConfig(c *check.C) {
+	conf := testConfig()
+	conf.Components = map[string]ComponentConfig{
+		"mongodb":   {Version: "3.0"},
+		"tsuru-api": {Image: "myregistry/tsuru-api:v1"},
+	}
+	conf.Iaas.Params = map[string]string{"driver": "virtualbox"}
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.created[0].CreationParams, check.DeepEquals, map[string]string{"driver": "virtualbox"})
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	mongo, err := client.InspectContainer("mongodb")
+	c.Assert(err, check.IsNil)
+	c.Assert(mongo.Config.Image, check.Equals, "mongo:3.0")
+	api, err := client.InspectContainer("tsuru-api")
+	c.Assert(err, check.IsNil)
+	c.Assert(api.Config.Image, check.Equals, "myregistry/tsuru-api:v1")
+}
+
+func (s *S) TestInstallGeneratesAdminPassword(c *check.C) {
+	conf := testConfig()
+	conf.Admin.Password = ""
+	i := s.installer(conf)
+	installation, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(installation.Admin.Password, check.HasLen, 24)
+	c.Assert(conf.Admin.Password, check.Equals, "")
+}
+
+func (s *S) TestInstallUnknownIaas(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Name = "unknown"
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+func (s *S) TestInstallNormalizesParams(c *check.C) {
+	conf := testConfig()
+	conf.Iaas = IaasConfig{Name: "schema-iaas", Params: map[string]string{"image": "ubuntu"}}
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.created[0].CreationParams, check.DeepEquals, map[string]string{"image": "ubuntu", "size": "small"})
+	c.Assert(conf.Iaas.Params, check.DeepEquals, map[string]string{"image": "ubuntu"})
+}
+
+func (s *S) TestInstallInvalidParams(c *check.C) {
+	conf := testConfig()
+	conf.Iaas = IaasConfig{Name: "schema-iaas", Params: map[string]string{"size": "huge"}}
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `invalid params for iaas "schema-iaas":
+  the parameter "image" is required
+  invalid value "huge" for param "size", it must be one of small, large`)
+	c.Assert(testProvider.created, check.HasLen, 0)
+	_, err = LoadState(conf.Name)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestInstallIaasWithoutDocker(c *check.C) {
+	conf := testConfig()
+	conf.Iaas = IaasConfig{Name: "no-docker-iaas"}
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `iaas "no-docker-iaas" can't be used to install tsuru: its machines don't run Docker`)
+	c.Assert(testProvider.created, check.HasLen, 0)
+}
+
+func (s *S) TestInstallMachineWithoutAddress(c *check.C) {
+	testProvider.address = ""
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.FitsTypeOf, &InstallError{})
+	c.Assert(err.(*InstallError).Err, check.Equals, errNoAddress)
+	c.Assert(testProvider.deleted, check.HasLen, 1)
+}
+
+func (s *S) TestInstallContainerFailure(c *check.C) {
+	s.server.PrepareFailure("create-error", "/containers/create")
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `(?s)unable to start mongodb: .*create-error.*`)
+	c.Assert(err.(*InstallError).Undone, check.DeepEquals, []string{"create-machines"})
+	c.Assert(testProvider.deleted, check.HasLen, 1)
+}
+
+func (s *S) TestInstallRollback(c *check.C) {
+	removed := s.recordRemoved()
+	var created int
+	s.server.CustomHandler("/containers/create", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		created++
+		if r.URL.Query().Get("name") == "registry" {
+			http.Error(w, "registry-error", http.StatusInternalServerError)
+			return
+		}
+		s.server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `(?s)unable to start registry: .*registry-error.*`)
+	// The registry is the fourth container, and the fifth one removes the
+	// data directories.
+	c.Assert(created, check.Equals, 5)
+	expected := []string{"start-hipache", "start-redis", "start-mongodb", "create-machines"}
+	c.Assert(err.(*InstallError).Undone, check.DeepEquals, expected)
+	c.Assert(removed(), check.DeepEquals, []string{"/var/lib/yati/tsuru"})
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	c.Assert(testProvider.deleted, check.HasLen, 1)
+}
+
+func (s *S) TestInstallMachineCreationFailure(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Name = "fake"
+	conf.Machines = 3
+	fake.Default.FailCreate(3, errors.New("quota exceeded"))
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, "quota exceeded")
+	c.Assert(fake.Default.Machines(), check.HasLen, 0)
+	calls := fake.Default.Calls()
+	c.Assert(calls, check.HasLen, 5)
+	c.Assert(calls[3], check.DeepEquals, fake.Call{Method: "DeleteMachine", Machine: "fake-1"})
+	c.Assert(calls[4], check.DeepEquals, fake.Call{Method: "DeleteMachine", Machine: "fake-2"})
+	_, err = LoadState(conf.Name)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestInstallRollbackMachineDeletionFailure(c *check.C) {
+	s.server.PrepareFailure("create-error", "/containers/create")
+	conf := testConfig()
+	conf.Iaas.Name = "fake"
+	fake.Default.FailDelete("fake-1", errors.New("machine is locked"))
+	var out bytes.Buffer
+	i := s.installer(conf)
+	i.Out = &out
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, `(?s)unable to start mongodb: .*create-error.*`)
+	c.Assert(err.(*InstallError).Undone, check.HasLen, 0)
+	c.Assert(out.String(), check.Matches, `(?s).*Failed to undo create-machines: unable to delete machine "fake-1": machine is locked.*`)
+	c.Assert(fake.Default.Machines(), check.DeepEquals, []string{"fake-1"})
+	state, err := LoadState(conf.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Machines, check.HasLen, 1)
+	c.Assert(state.Machines[0].Id, check.Equals, "fake-1")
+	fake.Default.FailDelete("fake-1", nil)
+	err = Uninstall(conf.Name, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(fake.Default.Machines(), check.HasLen, 0)
+}
+
+func (s *S) TestInstallSavesState(c *check.C) {
+	conf := testConfig()
+	conf.Admin.Password = ""
+	i := s.installer(conf)
+	installation, err := i.Install()
+	c.Assert(err, check.IsNil)
+	state, err := LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Iaas, check.Equals, "test-iaas")
+	c.Assert(state.APIURL, check.Equals, installation.APIURL)
+	c.Assert(state.Machines, check.DeepEquals, installation.Machines)
+	c.Assert(state.Containers, check.HasLen, 7)
+	c.Assert(state.Steps, check.DeepEquals, []string{
+		"create-machines", "start-mongodb", "setup-mongodb", "start-redis", "setup-redis",
+		"start-hipache", "start-registry", "trust-registry", "start-archive-server", "start-gandalf", "start-tsuru-api",
+		"check-router", "create-admin", "register-nodes", "setup-gandalf",
+	})
+	c.Assert(state.Secrets, check.HasLen, 5)
+	c.Assert(state.Secrets["admin-password"], check.Equals, installation.Admin.Password)
+	for _, name := range []string{"mongodb-admin-password", "mongodb-password", "mongodb-keyfile", "redis-password"} {
+		c.Assert(state.Secrets[name], check.Matches, "[0-9a-f]{24}")
+	}
+}
+
+func (s *S) TestInstallResume(c *check.C) {
+	conf := testConfig()
+	conf.Admin.Password = ""
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	// simulates an install interrupted while starting the tsuru API
+	state, err := LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	state.Steps = state.Steps[:10]
+	state.Containers = state.Containers[:6]
+	err = state.Save()
+	c.Assert(err, check.IsNil)
+	password := state.Secrets["admin-password"]
+	s.resetExecs()
+	var out bytes.Buffer
+	i.Out = &out
+	installation, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.created, check.HasLen, 1)
+	c.Assert(installation.Machines, check.DeepEquals, testProvider.created)
+	c.Assert(installation.Admin.Password, check.Equals, password)
+	c.Assert(out.String(), check.Matches, `(?s)Resuming installation "tsuru".*Skipping start-gandalf, already done.\nStarting tsuru-api.*Creating admin user.*`)
+	c.Assert(out.String(), check.Not(check.Matches), `(?s).*Creating machine.*`)
+	c.Assert(s.execInputs(), check.DeepEquals, []string{password + "\n" + password + "\n", ""})
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 7)
+}
+
+func (s *S) TestInstallAlreadyInstalled(c *check.C) {
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	_, err = i.Install()
+	c.Assert(err, check.ErrorMatches, `installation "tsuru" is already installed, uninstall it first`)
+	c.Assert(testProvider.created, check.HasLen, 1)
+}
+
+func (s *S) TestInstallResumeDifferentIaas(c *check.C) {
+	state := &State{Name: "tsuru", Iaas: "other-iaas"}
+	err := state.Save()
+	c.Assert(err, check.IsNil)
+	i := s.installer(testConfig())
+	_, err = i.Install()
+	c.Assert(err, check.ErrorMatches, `installation "tsuru" was created using iaas "other-iaas", not "test-iaas"`)
+}
+
+func (s *S) TestInstallFailureRemovesEmptyState(c *check.C) {
+	testProvider.address = ""
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.NotNil)
+	_, err = LoadState("tsuru")
+	c.Assert(err, check.ErrorMatches, `installation "tsuru" not found`)
+}
+
+func (s *S) TestParseImage(c *check.C) {
+	var tests = []struct {
+		image, repository, tag string
+	}{
+		{"mongo", "mongo", "latest"},
+		{"mongo:3.2", "mongo", "3.2"},
+		{"localhost:5000/tsuru/api", "localhost:5000/tsuru/api", "latest"},
+		{"localhost:5000/tsuru/api:v1", "localhost:5000/tsuru/api", "v1"},
+	}
+	for _, t := range tests {
+		repository, tag := parseImage(t.image)
+		c.Check(repository, check.Equals, t.repository)
+		c.Check(tag, check.Equals, t.tag)
+	}
+}
+
+func (s *S) TestParsePort(c *check.C) {
+	host, container := parsePort("2222:22")
+	c.Assert(host, check.Equals, "2222")
+	c.Assert(container, check.Equals, "22")
+	host, container = parsePort("8080")
+	c.Assert(host, check.Equals, "8080")
+	c.Assert(container, check.Equals, "8080")
+}
+
+func (s *S) TestDockerEndpoint(c *check.C) {
+	c.Assert(dockerEndpoint(&iaas.Machine{Address: "10.0.0.1"}), check.Equals, "http://10.0.0.1:2375")
+	m := &iaas.Machine{Address: "10.0.0.1", Port: 2376, ClientCert: "cert.pem"}
+	c.Assert(dockerEndpoint(m), check.Equals, "https://10.0.0.1:2376")
+	m = &iaas.Machine{Address: "172.17.0.1", Endpoint: "unix:///var/run/docker.sock"}
+	c.Assert(dockerEndpoint(m), check.Equals, "unix:///var/run/docker.sock")
+}
+
+func (s *S) TestTsuruConfig(c *check.C) {
+	conf, err := tsuruConfig(DefaultConfig(), &iaas.Machine{Address: "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(conf, check.Matches, `(?s).*url: mongodb://tsuru:@10.0.0.1:27017/admin\n.*`)
+	c.Assert(conf, check.Matches, `(?s).*host: http://10.0.0.1:8080.*`)
+	c.Assert(conf, check.Matches, `(?s).*registry: 10.0.0.1:5000.*`)
+	c.Assert(conf, check.Matches, `(?s).*domain: 10.0.0.1.nip.io.*`)
+}
+
+func (s *S) TestTsuruConfigDomain(c *check.C) {
+	conf := DefaultConfig()
+	conf.Domain = "cloud.example.com"
+	content, err := tsuruConfig(conf, &iaas.Machine{Address: "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.Matches, `(?s).*domain: cloud.example.com.*`)
+}
@@ -0,0 +1,203 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/action"
+	"gopkg.in/mgo.v2"
+)
+
+const (
+	mongoReplicaSet   = "tsuru"
+	mongoMembers      = 3
+	mongoKeyFilePath  = "/etc/mongodb/keyfile"
+	mongoAdminUser    = "admin"
+	mongoTsuruUser    = "tsuru"
+	mongoSetupTimeout = 60
+)
+
+// mongoDialTimeout is the time to wait for MongoDB when checking the
+// credentials used by tsuru.
+var mongoDialTimeout = 30 * time.Second
+
+// pingMongoDB connects to MongoDB using the given URL, to check the
+// credentials given to tsuru.
+func pingMongoDB(mongoURL string) error {
+	info, err := mgo.ParseURL(mongoURL)
+	if err != nil {
+		return err
+	}
+	info.Timeout = mongoDialTimeout
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Ping()
+}
+
+// mongoWaitScript waits for mongod to accept connections and then runs the
+// script read from stdin in the admin database, so the passwords never show
+// up in the command line.
+const mongoWaitScript = `for i in $(seq %d); do
+  mongo --quiet --eval 'quit(0)' </dev/null >/dev/null 2>&1 && exec mongo --quiet admin
+  sleep 1
+done
+echo "mongod is not accepting connections" >&2
+exit 1
+`
+
+// mongoKeyFileScript copies the key file shared by the replica set members
+// to a path readable only by mongod before starting it.
+const mongoKeyFileScript = `cp %[1]s /data/keyfile && chown mongodb /data/keyfile && chmod 600 /data/keyfile && exec docker-entrypoint.sh mongod --auth --replSet %[2]s --keyFile /data/keyfile`
+
+// mongoComponents returns the MongoDB containers: a single one, or the
+// members of the replica set when it's enabled. Every container keeps its
+// data in a directory of the host, so it survives the container.
+func mongoComponents(conf *Config) []*Component {
+	image := conf.image("mongodb", "mongo:3.2")
+	if !conf.MongoDB.ReplicaSet {
+		return []*Component{{
+			Name:  "mongodb",
+			Image: image,
+			Ports: []string{fmt.Sprint(mongoPort)},
+			Cmd:   []string{"mongod", "--auth"},
+			Binds: []string{conf.MongoDB.DataDir + ":/data/db"},
+			Setup: &setupMongoDB,
+		}}
+	}
+	var comps []*Component
+	for n := 0; n < mongoMembers; n++ {
+		name := mongoMemberName(n)
+		comps = append(comps, &Component{
+			Name:  name,
+			Image: image,
+			Ports: []string{fmt.Sprintf("%d:%d", mongoPort+n, mongoPort)},
+			Cmd:   []string{"sh", "-c", fmt.Sprintf(mongoKeyFileScript, mongoKeyFilePath, mongoReplicaSet)},
+			Binds: []string{fmt.Sprintf("%s/%s:/data/db", conf.MongoDB.DataDir, name)},
+			Files: func(m *iaas.Machine) (map[string]string, error) {
+				return map[string]string{mongoKeyFilePath: conf.MongoDB.keyFile + "\n"}, nil
+			},
+		})
+	}
+	comps[len(comps)-1].Setup = &setupMongoDB
+	return comps
+}
+
+// mongoMemberName returns the name of the container running the nth member
+// of the replica set. The first one has a higher priority, so it's the
+// primary where the users are created.
+func mongoMemberName(n int) string {
+	if n == 0 {
+		return "mongodb"
+	}
+	return fmt.Sprintf("mongodb-%d", n+1)
+}
+
+// mongoAddrs returns the addresses of the MongoDB servers in the machine.
+func mongoAddrs(conf *Config, m *iaas.Machine) []string {
+	members := 1
+	if conf.MongoDB.ReplicaSet {
+		members = mongoMembers
+	}
+	addrs := make([]string, members)
+	for n := range addrs {
+		addrs[n] = fmt.Sprintf("%s:%d", m.Address, mongoPort+n)
+	}
+	return addrs
+}
+
+// mongoURL returns the URL used by tsuru to connect to MongoDB, with the
+// credentials of the tsuru user.
+func mongoURL(conf *Config, m *iaas.Machine) string {
+	u := fmt.Sprintf("mongodb://%s:%s@%s/admin", mongoTsuruUser, url.QueryEscape(conf.MongoDB.Password), strings.Join(mongoAddrs(conf, m), ","))
+	if conf.MongoDB.ReplicaSet {
+		u += "?replicaSet=" + mongoReplicaSet
+	}
+	return u
+}
+
+// mongoQuote returns the value as a literal of the mongo shell.
+func mongoQuote(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// mongoRemoveUserScript returns the mongo shell script that removes the
+// tsuru user with the given email, authenticating as the admin.
+func mongoRemoveUserScript(conf *Config, email string) string {
+	var script bytes.Buffer
+	script.WriteString("try {\n")
+	fmt.Fprintf(&script, "  if (!db.auth(%s, %s)) throw \"unable to authenticate as %s\";\n", mongoQuote(mongoAdminUser), mongoQuote(conf.MongoDB.AdminPassword), mongoAdminUser)
+	fmt.Fprintf(&script, "  db.getSiblingDB(%s).users.remove({email: %s});\n", mongoQuote(tsuruDatabase), mongoQuote(email))
+	script.WriteString("} catch (e) {\n  print(e);\n  quit(1);\n}\n")
+	return script.String()
+}
+
+// mongoSetupScript returns the mongo shell script that initiates the
+// replica set and creates the admin and tsuru users. Users that already
+// exist are kept, so the script can run again when an install is resumed.
+func mongoSetupScript(conf *Config, m *iaas.Machine) string {
+	quote := mongoQuote
+	var script bytes.Buffer
+	script.WriteString("try {\n")
+	fmt.Fprintf(&script, "  if (!db.auth(%s, %s)) {\n", quote(mongoAdminUser), quote(conf.MongoDB.AdminPassword))
+	if conf.MongoDB.ReplicaSet {
+		var members []map[string]interface{}
+		for n, addr := range mongoAddrs(conf, m) {
+			member := map[string]interface{}{"_id": n, "host": addr}
+			if n == 0 {
+				member["priority"] = 2
+			}
+			members = append(members, member)
+		}
+		fmt.Fprintf(&script, "    rs.initiate(%s);\n", quote(map[string]interface{}{"_id": mongoReplicaSet, "members": members}))
+		fmt.Fprintf(&script, "    for (var i = 0; !db.isMaster().ismaster; i++) {\n")
+		fmt.Fprintf(&script, "      if (i == %d) throw \"the replica set has no primary\";\n", mongoSetupTimeout)
+		fmt.Fprintf(&script, "      sleep(1000);\n")
+		fmt.Fprintf(&script, "    }\n")
+	}
+	fmt.Fprintf(&script, "    db.createUser({user: %s, pwd: %s, roles: [\"root\"]});\n", quote(mongoAdminUser), quote(conf.MongoDB.AdminPassword))
+	fmt.Fprintf(&script, "    db.auth(%s, %s);\n", quote(mongoAdminUser), quote(conf.MongoDB.AdminPassword))
+	script.WriteString("  }\n")
+	fmt.Fprintf(&script, "  if (db.getUser(%s) == null) {\n", quote(mongoTsuruUser))
+	fmt.Fprintf(&script, "    db.createUser({user: %s, pwd: %s, roles: [\"readWriteAnyDatabase\", \"dbAdminAnyDatabase\"]});\n", quote(mongoTsuruUser), quote(conf.MongoDB.Password))
+	script.WriteString("  }\n")
+	script.WriteString("} catch (e) {\n  print(e);\n  quit(1);\n}\n")
+	return script.String()
+}
+
+// setupMongoDB creates the MongoDB users, initiating the replica set first
+// when it's enabled, and checks that tsuru is able to connect. The users
+// live in the data directory, created only when they're missing, and their
+// passwords in the state. Both are kept while the machines are, and removed
+// together when createMachines is rolled back, so there's no Backward.
+var setupMongoDB = action.Action{
+	Name: "setup-mongodb",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		fmt.Fprintf(args.out, "Setting up MongoDB...\n")
+		cmd := []string{"sh", "-c", fmt.Sprintf(mongoWaitScript, mongoSetupTimeout)}
+		script := mongoSetupScript(args.config, args.machine())
+		err := execInContainer(args.client, args.containerID("mongodb"), cmd, script)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up MongoDB: %s", err)
+		}
+		err = args.hooks.PingMongoDB(mongoURL(args.config, args.machine()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to MongoDB: %s", err)
+		}
+		return nil, nil
+	},
+	MinParams: 1,
+}
@@ -0,0 +1,188 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/action"
+)
+
+// defaultPool is the pool of the nodes added by the installer. It's the
+// default pool of tsuru, so apps are deployed to it.
+const defaultPool = "default"
+
+// tsuruAPI is a client of the tsuru API, authenticated as the admin user.
+type tsuruAPI struct {
+	url   string
+	token string
+}
+
+// apiError is an error response of the tsuru API.
+type apiError struct {
+	Code    int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// loginTsuru creates a token for the admin user in the tsuru API.
+func loginTsuru(apiURL string, admin AdminConfig) (*tsuruAPI, error) {
+	api := &tsuruAPI{url: apiURL}
+	var result struct {
+		Token string `json:"token"`
+	}
+	err := api.do("POST", "/users/"+admin.Email+"/tokens", map[string]string{"password": admin.Password}, &result)
+	if err != nil {
+		return nil, err
+	}
+	api.token = result.Token
+	return api, nil
+}
+
+// do sends the body in JSON to the API, decoding the response into result
+// when it isn't nil.
+func (a *tsuruAPI) do(method, path string, body, result interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, a.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "bearer "+a.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return &apiError{Code: resp.StatusCode, Message: strings.TrimSpace(string(respBody))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+func (a *tsuruAPI) removeNode(address string) error {
+	return a.do("DELETE", "/docker/node?no-rebalance=true", map[string]string{"address": address}, nil)
+}
+
+// addNodes registers the Docker daemons in the given addresses as nodes of
+// tsuru, in the default pool. The pool is created unless there's already a
+// default pool, like one created by an interrupted install. The nodes added
+// are removed when one of them fails.
+func addNodes(apiURL string, admin AdminConfig, addresses []string) error {
+	api, err := loginTsuru(apiURL, admin)
+	if err != nil {
+		return err
+	}
+	pool := map[string]interface{}{"Name": defaultPool, "Public": true, "Default": true}
+	err = api.do("POST", "/pool", pool, nil)
+	if e, ok := err.(*apiError); ok && e.Code == http.StatusConflict {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, address := range addresses {
+		err = api.do("POST", "/docker/node?register=true", map[string]string{"address": address, "pool": defaultPool}, nil)
+		if err != nil {
+			for _, added := range addresses[:i] {
+				api.removeNode(added)
+			}
+			return fmt.Errorf("node %s: %s", address, err)
+		}
+	}
+	return nil
+}
+
+// removeNodes removes the nodes in the given addresses from tsuru, and then
+// the default pool.
+func removeNodes(apiURL string, admin AdminConfig, addresses []string) error {
+	api, err := loginTsuru(apiURL, admin)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		err = api.removeNode(address)
+		if err != nil {
+			return fmt.Errorf("node %s: %s", address, err)
+		}
+	}
+	return api.do("DELETE", "/pool", map[string]string{"pool": defaultPool}, nil)
+}
+
+// nodeAddress returns the address tsuru uses to reach the Docker of the
+// machine. It's empty when Docker listens on a unix socket, which the tsuru
+// API can't reach from its container.
+func nodeAddress(m *iaas.Machine) string {
+	endpoint := dockerEndpoint(m)
+	if strings.HasPrefix(endpoint, "unix://") {
+		return ""
+	}
+	if strings.HasPrefix(endpoint, "tcp://") {
+		scheme := "http"
+		if m.ClientCert != "" {
+			scheme = "https"
+		}
+		return scheme + "://" + strings.TrimPrefix(endpoint, "tcp://")
+	}
+	return endpoint
+}
+
+// registerNodes adds the Docker of every machine as a node of tsuru, so apps
+// can be deployed right after the install. The nodes are removed on
+// rollback.
+var registerNodes = action.Action{
+	Name: "register-nodes",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		var addresses []string
+		for _, m := range args.state.Machines {
+			address := nodeAddress(m)
+			if address == "" {
+				fmt.Fprintf(args.out, "Docker of machine %s listens on a unix socket, skipping its registration as a node.\n", m.Id)
+				continue
+			}
+			addresses = append(addresses, address)
+		}
+		if len(addresses) == 0 {
+			return addresses, nil
+		}
+		fmt.Fprintf(args.out, "Registering %d node(s) in pool %q...\n", len(addresses), defaultPool)
+		err := args.hooks.AddNodes(args.state.APIURL, args.config.Admin, addresses)
+		if err != nil {
+			return nil, fmt.Errorf("unable to register nodes: %s", err)
+		}
+		return addresses, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		args := ctx.Params[0].(*installArgs)
+		addresses := ctx.FWResult.([]string)
+		if len(addresses) == 0 {
+			return
+		}
+		args.undo("register-nodes", args.hooks.RemoveNodes(args.state.APIURL, args.config.Admin, addresses))
+	},
+	MinParams: 1,
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestNodeAddress(c *check.C) {
+	c.Assert(nodeAddress(&iaas.Machine{Address: "10.0.0.1", Port: 2375}), check.Equals, "http://10.0.0.1:2375")
+	c.Assert(nodeAddress(&iaas.Machine{Address: "10.0.0.1", Port: 2376, ClientCert: "cert.pem"}), check.Equals, "https://10.0.0.1:2376")
+	c.Assert(nodeAddress(&iaas.Machine{Endpoint: "tcp://10.0.0.2:2375"}), check.Equals, "http://10.0.0.2:2375")
+	c.Assert(nodeAddress(&iaas.Machine{Endpoint: "unix:///var/run/docker.sock"}), check.Equals, "")
+}
+
+// fakeTsuruAPI records the requests sent to the tsuru API, answering the
+// login with a token and the paths in failures with their status.
+func fakeTsuruAPI(requests *[]string, failures map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		*requests = append(*requests, fmt.Sprintf("%s %s %s %s", r.Method, r.URL.RequestURI(), r.Header.Get("Authorization"), body))
+		if code := failures[r.Method+" "+r.URL.RequestURI()]; code != 0 {
+			http.Error(w, "failed", code)
+			return
+		}
+		if r.URL.Path == "/users/admin@example.com/tokens" {
+			w.Write([]byte(`{"token":"abc"}`))
+		}
+	}))
+}
+
+func (s *S) TestAddNodes(c *check.C) {
+	var requests []string
+	server := fakeTsuruAPI(&requests, map[string]int{"POST /pool": http.StatusConflict})
+	defer server.Close()
+	admin := AdminConfig{Email: "admin@example.com", Password: "secret"}
+	err := addNodes(server.URL, admin, []string{"http://10.0.0.1:2375", "http://10.0.0.2:2375"})
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.DeepEquals, []string{
+		`POST /users/admin@example.com/tokens  {"password":"secret"}`,
+		`POST /pool bearer abc {"Default":true,"Name":"default","Public":true}`,
+		`POST /docker/node?register=true bearer abc {"address":"http://10.0.0.1:2375","pool":"default"}`,
+		`POST /docker/node?register=true bearer abc {"address":"http://10.0.0.2:2375","pool":"default"}`,
+	})
+}
+
+func (s *S) TestAddNodesFailure(c *check.C) {
+	var requests []string
+	server := fakeTsuruAPI(&requests, map[string]int{"POST /docker/node?register=true": http.StatusBadRequest})
+	defer server.Close()
+	admin := AdminConfig{Email: "admin@example.com", Password: "secret"}
+	err := addNodes(server.URL, admin, []string{"http://10.0.0.1:2375"})
+	c.Assert(err, check.ErrorMatches, "node http://10.0.0.1:2375: 400 failed")
+}
+
+func (s *S) TestAddNodesInvalidPassword(c *check.C) {
+	var requests []string
+	server := fakeTsuruAPI(&requests, map[string]int{"POST /users/admin@example.com/tokens": http.StatusUnauthorized})
+	defer server.Close()
+	err := addNodes(server.URL, AdminConfig{Email: "admin@example.com"}, []string{"http://10.0.0.1:2375"})
+	c.Assert(err, check.ErrorMatches, "401 failed")
+	c.Assert(requests, check.HasLen, 1)
+}
+
+func (s *S) TestRemoveNodes(c *check.C) {
+	var requests []string
+	server := fakeTsuruAPI(&requests, nil)
+	defer server.Close()
+	admin := AdminConfig{Email: "admin@example.com", Password: "secret"}
+	err := removeNodes(server.URL, admin, []string{"http://10.0.0.1:2375"})
+	c.Assert(err, check.IsNil)
+	c.Assert(requests[1:], check.DeepEquals, []string{
+		`DELETE /docker/node?no-rebalance=true bearer abc {"address":"http://10.0.0.1:2375"}`,
+		`DELETE /pool bearer abc {"pool":"default"}`,
+	})
+}
+
+func (s *S) TestInstallRegistersNodes(c *check.C) {
+	conf := testConfig()
+	conf.Machines = 2
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	address := fmt.Sprintf("http://%s:%d", testProvider.address, testProvider.port)
+	c.Assert(s.nodes, check.DeepEquals, []string{address, address})
+}
+
+func (s *S) TestInstallRemovesNodesOnRollback(c *check.C) {
+	conf := testConfig()
+	f, err := ioutil.TempFile("", "yati")
+	c.Assert(err, check.IsNil)
+	f.WriteString(testSSHKey)
+	f.Close()
+	conf.Admin.SSHKey = f.Name()
+	i := s.installer(conf)
+	i.AddSSHKey = func(string, string, string) error {
+		return errors.New("key rejected")
+	}
+	_, err = i.Install()
+	c.Assert(err, check.NotNil)
+	c.Assert(s.removedNodes, check.DeepEquals, s.nodes)
+	c.Assert(s.removedNodes, check.HasLen, 1)
+}
+
+func (s *S) TestInstallNodesFailure(c *check.C) {
+	i := s.installer(testConfig())
+	i.AddNodes = func(string, AdminConfig, []string) error {
+		return errors.New("pool is required")
+	}
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, "unable to register nodes: pool is required")
+	c.Assert(err.(*InstallError).Undone[:2], check.DeepEquals, []string{"create-admin", "start-tsuru-api"})
+}
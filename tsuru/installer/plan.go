@@ -0,0 +1,122 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+)
+
+// Plan writes to Out everything Install would do: the machines created with
+// their params, the containers started in the first machine and the files
+// copied to them. Only the iaas params must be valid, the other problems
+// found are listed, along with the machines that already exist in the iaas.
+// No machine is created and Docker isn't contacted. The addresses of the
+// machines aren't known yet, so they're shown as <machine-N>.
+func (i *Installer) Plan() error {
+	out, conf, provider, err := i.resolve()
+	if err != nil {
+		return err
+	}
+	// The secrets are shown in the files, and the generated ones aren't
+	// known yet.
+	conf.MongoDB.AdminPassword = "hidden"
+	conf.MongoDB.Password = "hidden"
+	conf.MongoDB.keyFile = "hidden"
+	conf.Redis.Password = "hidden"
+	conf.Router.Password = "hidden"
+	conf.Registry.Password = "hidden"
+	conf.Registry.cert = "hidden"
+	conf.Registry.key = "hidden"
+	fmt.Fprintf(out, "Installation %q using iaas %q\n", conf.Name, conf.Iaas.Name)
+	if errs := problems(conf); len(errs) > 0 {
+		fmt.Fprintf(out, "\nProblems that make the install fail:\n")
+		for _, err := range errs {
+			fmt.Fprintf(out, "  %s\n", err)
+		}
+	}
+	fmt.Fprintf(out, "\nMachines:\n")
+	for n := 0; n < conf.Machines; n++ {
+		fmt.Fprintf(out, "  <machine-%d>\n", n+1)
+		writeList(out, "params", formatParams(machineParams(conf, n)))
+	}
+	existing, err := provider.ListMachines(conf.Iaas.Params)
+	if err != nil {
+		fmt.Fprintf(out, "\nUnable to list the machines that already exist: %s\n", err)
+	} else if len(existing) > 0 {
+		fmt.Fprintf(out, "\nMachines that already exist in the iaas:\n")
+		for _, m := range existing {
+			fmt.Fprintf(out, "  %s (%s, %s)\n", m.Id, m.Status, m.Address)
+		}
+	}
+	m := &iaas.Machine{Address: "<machine-1>"}
+	fmt.Fprintf(out, "\nContainers in <machine-1>:\n")
+	var files []string
+	contents := make(map[string]string)
+	for _, c := range components(conf) {
+		fmt.Fprintf(out, "  %s\n", c.Name)
+		fmt.Fprintf(out, "    image: %s\n", c.Image)
+		writeList(out, "ports", c.Ports)
+		writeList(out, "env", c.Env)
+		writeList(out, "cmd", c.Cmd)
+		writeList(out, "binds", c.Binds)
+		if c.Files == nil {
+			continue
+		}
+		componentFiles, err := c.Files(m)
+		if err != nil {
+			return err
+		}
+		var paths []string
+		for path, content := range componentFiles {
+			paths = append(paths, path)
+			key := c.Name + ":" + path
+			files = append(files, key)
+			contents[key] = content
+		}
+		sort.Strings(paths)
+		writeList(out, "files", paths)
+	}
+	sort.Strings(files)
+	for _, key := range files {
+		fmt.Fprintf(out, "\n%s:\n", key)
+		for _, line := range strings.Split(strings.TrimRight(contents[key], "\n"), "\n") {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+	}
+	var nodes []string
+	for n := 1; n <= conf.Machines; n++ {
+		nodes = append(nodes, fmt.Sprintf("<machine-%d>", n))
+	}
+	fmt.Fprintf(out, "\nNodes in pool %q: %s\n", defaultPool, strings.Join(nodes, ", "))
+	password := conf.Admin.Password
+	if password == "" {
+		password = "(generated)"
+	} else {
+		password = strings.Repeat("*", len(password))
+	}
+	fmt.Fprintf(out, "\nAdmin user: %s\n", conf.Admin.Email)
+	fmt.Fprintf(out, "Admin password: %s\n", password)
+	return nil
+}
+
+func writeList(out io.Writer, name string, values []string) {
+	if len(values) > 0 {
+		fmt.Fprintf(out, "    %s: %s\n", name, strings.Join(values, ", "))
+	}
+}
+
+func formatParams(params map[string]string) []string {
+	var result []string
+	for k, v := range params {
+		result = append(result, k+"="+v)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestPlan(c *check.C) {
+	conf := testConfig()
+	conf.Machines = 2
+	conf.Iaas.Params = map[string]string{"driver": "virtualbox", "cpus": "2"}
+	var out bytes.Buffer
+	i := s.installer(conf)
+	i.Out = &out
+	err := i.Plan()
+	c.Assert(err, check.IsNil)
+	plan := out.String()
+	c.Assert(plan, check.Matches, `(?s)Installation "tsuru" using iaas "test-iaas"
+
+Machines:
+  <machine-1>
+    params: cpus=2, driver=virtualbox
+  <machine-2>
+    params: cpus=2, driver=virtualbox
+
+Containers in <machine-1>:
+  mongodb
+    image: mongo:3.2
+    ports: 27017
+    cmd: mongod, --auth
+    binds: /var/lib/yati/tsuru/mongodb:/data/db
+.*`)
+	c.Assert(plan, check.Matches, `(?s).*  gandalf\n    image: tsuru/gandalf\n    ports: 8000, 2222:22\n.*`)
+	c.Assert(plan, check.Matches, `(?s).*    files: /etc/tsuru/tsuru.conf\n.*`)
+	c.Assert(plan, check.Matches, `(?s).*tsuru-api:/etc/tsuru/tsuru.conf:\n.*  host: http://<machine-1>:8080\n.*`)
+	c.Assert(plan, check.Matches, `(?s).*  url: mongodb://tsuru:hidden@<machine-1>:27017/admin\n.*`)
+	c.Assert(plan, check.Matches, `(?s).*\nNodes in pool "default": <machine-1>, <machine-2>\n\nAdmin user: admin@example.com\nAdmin password: \*\*\*\*\*\*\n$`)
+	c.Assert(testProvider.created, check.HasLen, 0)
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	_, err = LoadState("tsuru")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *S) TestPlanExistingMachines(c *check.C) {
+	testProvider.created = []*iaas.Machine{{Id: "test-machine-1", Status: "running", Address: "10.0.0.1"}}
+	var out bytes.Buffer
+	i := s.installer(testConfig())
+	i.Out = &out
+	err := i.Plan()
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Matches, `(?s).*\n  <machine-1>\n\nMachines that already exist in the iaas:\n  test-machine-1 \(running, 10\.0\.0\.1\)\n\nContainers in <machine-1>:.*`)
+	c.Assert(testProvider.created, check.HasLen, 1)
+}
+
+func (s *S) TestPlanGeneratedPassword(c *check.C) {
+	conf := testConfig()
+	conf.Admin.Password = ""
+	var out bytes.Buffer
+	i := s.installer(conf)
+	i.Out = &out
+	err := i.Plan()
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Matches, `(?s).*Admin password: \(generated\)\n$`)
+}
+
+func (s *S) TestPlanUnknownIaas(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Name = "unknown"
+	i := s.installer(conf)
+	err := i.Plan()
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+func (s *S) TestPlanListsProblems(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Name = "no-docker-iaas"
+	conf.Admin.SSHKey = "/tmp/yati-not-found.pub"
+	var out bytes.Buffer
+	i := s.installer(conf)
+	i.Out = &out
+	err := i.Plan()
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Matches, `(?s)Installation "tsuru" using iaas "no-docker-iaas"
+
+Problems that make the install fail:
+  iaas "no-docker-iaas" can't be used to install tsuru: its machines don't run Docker
+  unable to read SSH key: .*
+
+Machines:
+.*`)
+}
+
+func (s *S) TestPlanInvalidParams(c *check.C) {
+	conf := testConfig()
+	conf.Iaas.Name = "schema-iaas"
+	i := s.installer(conf)
+	err := i.Plan()
+	c.Assert(err, check.ErrorMatches, `(?s)invalid params for iaas "schema-iaas":.*`)
+}
@@ -0,0 +1,130 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/garyburd/redigo/redis"
+	"github.com/tsuru/tsuru/action"
+)
+
+const redisConfigPath = "/usr/local/etc/redis/redis.conf"
+
+// redisStartTimeout is the time to wait for Redis to answer after its
+// container is started.
+var redisStartTimeout = 30 * time.Second
+
+// pingRedis sends a PING to the Redis in the given URL, retrying until
+// Redis starts.
+func pingRedis(redisURL string) error {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(redisStartTimeout)
+	for {
+		err = pingURL(u)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func pingURL(u *url.URL) error {
+	conn, err := dialURL(u)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("PING")
+	return err
+}
+
+// dialRedis connects to the Redis in the given URL, authenticating with
+// its password.
+func dialRedis(redisURL string) (redis.Conn, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	return dialURL(u)
+}
+
+func dialURL(u *url.URL) (redis.Conn, error) {
+	conn, err := redis.DialTimeout("tcp", u.Host, redisStartTimeout, redisStartTimeout, redisStartTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if password, ok := u.User.Password(); ok {
+		_, err = conn.Do("AUTH", password)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func redisComponent(conf *Config) *Component {
+	return &Component{
+		Name:  "redis",
+		Image: "redis:3.0",
+		Ports: []string{fmt.Sprint(redisPort)},
+		Cmd:   []string{"redis-server", redisConfigPath},
+		Binds: []string{conf.Redis.DataDir + ":/data"},
+		Files: func(m *iaas.Machine) (map[string]string, error) {
+			return map[string]string{redisConfigPath: redisConfig(conf)}, nil
+		},
+		Setup: &setupRedis,
+	}
+}
+
+// redisConfig returns the redis.conf used by the Redis container. The
+// append only file is enabled, so the routes survive a restart.
+func redisConfig(conf *Config) string {
+	var buf bytes.Buffer
+	buf.WriteString("dir /data\nappendonly yes\n")
+	fmt.Fprintf(&buf, "requirepass %s\n", conf.Redis.Password)
+	if conf.Redis.MaxMemory != "" {
+		fmt.Fprintf(&buf, "maxmemory %s\n", conf.Redis.MaxMemory)
+	}
+	return buf.String()
+}
+
+// redisURL returns the URL of the Redis in the machine, with its password.
+func redisURL(conf *Config, m *iaas.Machine) string {
+	u := url.URL{
+		Scheme: "redis",
+		User:   url.UserPassword("", conf.Redis.Password),
+		Host:   redisAddr(m),
+	}
+	return u.String()
+}
+
+func redisAddr(m *iaas.Machine) string {
+	return fmt.Sprintf("%s:%d", m.Address, redisPort)
+}
+
+// setupRedis checks that Redis accepts the password given to tsuru and to
+// the router.
+var setupRedis = action.Action{
+	Name: "setup-redis",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		fmt.Fprintf(args.out, "Checking Redis...\n")
+		err := args.hooks.PingRedis(redisURL(args.config, args.machine()))
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Redis: %s", err)
+		}
+		return nil, nil
+	},
+	MinParams: 1,
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestRedisComponent(c *check.C) {
+	conf := DefaultConfig()
+	conf.Redis.Password = "secret"
+	conf.Redis.MaxMemory = "256mb"
+	comp := redisComponent(conf)
+	c.Assert(comp.Name, check.Equals, "redis")
+	c.Assert(comp.Cmd, check.DeepEquals, []string{"redis-server", "/usr/local/etc/redis/redis.conf"})
+	c.Assert(comp.Binds, check.DeepEquals, []string{"/var/lib/yati/tsuru/redis:/data"})
+	c.Assert(comp.Setup, check.Equals, &setupRedis)
+	files, err := comp.Files(&iaas.Machine{})
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.DeepEquals, map[string]string{
+		"/usr/local/etc/redis/redis.conf": "dir /data\nappendonly yes\nrequirepass secret\nmaxmemory 256mb\n",
+	})
+}
+
+func (s *S) TestRedisURL(c *check.C) {
+	conf := DefaultConfig()
+	conf.Redis.Password = "p@ss"
+	c.Assert(redisURL(conf, &iaas.Machine{Address: "10.0.0.1"}), check.Equals, "redis://:p%40ss@10.0.0.1:6379")
+}
+
+func (s *S) TestInstallRedis(c *check.C) {
+	conf := testConfig()
+	conf.Redis.Password = "redis-secret"
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	redis, err := client.InspectContainer("redis")
+	c.Assert(err, check.IsNil)
+	c.Assert(redis.HostConfig.Binds, check.DeepEquals, []string{"/var/lib/yati/tsuru/redis:/data"})
+	expected := fmt.Sprintf("redis://:redis-secret@%s:6379", testProvider.address)
+	c.Assert(s.redisPings, check.DeepEquals, []string{expected})
+	var hipache, tsuru bool
+	for _, archive := range s.uploads() {
+		hipache = hipache || strings.Contains(string(archive), `"driver": "`+expected+`"`)
+		tsuru = tsuru || strings.Contains(string(archive), "redis-password: redis-secret\n")
+	}
+	c.Assert(hipache, check.Equals, true)
+	c.Assert(tsuru, check.Equals, true)
+}
+
+func (s *S) TestInstallRedisPingFailure(c *check.C) {
+	i := s.installer(testConfig())
+	i.PingRedis = func(string) error {
+		return errors.New("NOAUTH Authentication required")
+	}
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, "unable to connect to Redis: NOAUTH Authentication required")
+	c.Assert(err.(*InstallError).Undone, check.DeepEquals, []string{"start-redis", "start-mongodb", "create-machines"})
+}
+
+// fakeRedis answers AUTH and PING like Redis, recording the commands.
+func fakeRedis(c *check.C, password string) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	commands := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			var args []string
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var n int
+			fmt.Sscanf(line, "*%d", &n)
+			for ; n > 0; n-- {
+				r.ReadString('\n')
+				arg, _ := r.ReadString('\n')
+				args = append(args, strings.TrimSpace(arg))
+			}
+			commands <- strings.Join(args, " ")
+			switch {
+			case args[0] == "AUTH" && args[1] == password:
+				conn.Write([]byte("+OK\r\n"))
+			case args[0] == "AUTH":
+				conn.Write([]byte("-ERR invalid password\r\n"))
+			default:
+				conn.Write([]byte("+PONG\r\n"))
+			}
+		}
+	}()
+	return l.Addr().String(), commands
+}
+
+func (s *S) TestPingRedis(c *check.C) {
+	addr, commands := fakeRedis(c, "secret")
+	err := pingRedis("redis://:secret@" + addr)
+	c.Assert(err, check.IsNil)
+	c.Assert(<-commands, check.Equals, "AUTH secret")
+	c.Assert(<-commands, check.Equals, "PING")
+}
+
+func (s *S) TestPingRedisInvalidPassword(c *check.C) {
+	timeout := redisStartTimeout
+	redisStartTimeout = 0
+	defer func() { redisStartTimeout = timeout }()
+	addr, _ := fakeRedis(c, "secret")
+	err := pingRedis("redis://:wrong@" + addr)
+	c.Assert(err, check.ErrorMatches, "ERR invalid password")
+}
+
+func (s *S) TestPingRedisRetries(c *check.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	addr := l.Addr().String()
+	l.Close()
+	timeout := redisStartTimeout
+	redisStartTimeout = time.Second
+	defer func() { redisStartTimeout = timeout }()
+	start := time.Now()
+	err = pingRedis("redis://:secret@" + addr)
+	c.Assert(err, check.NotNil)
+	c.Assert(time.Since(start) >= time.Second, check.Equals, true)
+}
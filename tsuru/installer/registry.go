@@ -0,0 +1,237 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/tsuru/tsuru/action"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	registryCertPath     = "/certs/registry.crt"
+	registryKeyPath      = "/certs/registry.key"
+	registryHtpasswdPath = "/auth/htpasswd"
+
+	// dockerCertsDir is the directory of the host where Docker looks for
+	// the certificates of the registries it trusts.
+	dockerCertsDir = "/etc/docker/certs.d"
+)
+
+// registryComponent returns the Docker registry where tsuru pushes the
+// images of the apps. It's served with TLS and, when a username is set,
+// requires basic auth. The images are kept in a directory of the host.
+func registryComponent(conf *Config) *Component {
+	env := []string{
+		"REGISTRY_HTTP_TLS_CERTIFICATE=" + registryCertPath,
+		"REGISTRY_HTTP_TLS_KEY=" + registryKeyPath,
+	}
+	if conf.Registry.Username != "" {
+		env = append(env,
+			"REGISTRY_AUTH=htpasswd",
+			"REGISTRY_AUTH_HTPASSWD_REALM=tsuru",
+			"REGISTRY_AUTH_HTPASSWD_PATH="+registryHtpasswdPath,
+		)
+	}
+	return &Component{
+		Name:  "registry",
+		Image: "registry:2",
+		Ports: []string{fmt.Sprint(registryPort)},
+		Env:   env,
+		Binds: []string{conf.Registry.DataDir + ":/var/lib/registry"},
+		Files: func(m *iaas.Machine) (map[string]string, error) {
+			return registryFiles(conf, m)
+		},
+		Setup: &trustRegistry,
+	}
+}
+
+func registryFiles(conf *Config, m *iaas.Machine) (map[string]string, error) {
+	cert, key, err := registryCert(conf, m)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]string{
+		registryCertPath: cert,
+		registryKeyPath:  key,
+	}
+	if conf.Registry.Username != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(conf.Registry.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		files[registryHtpasswdPath] = fmt.Sprintf("%s:%s\n", conf.Registry.Username, hash)
+	}
+	return files, nil
+}
+
+func registryAddr(m *iaas.Machine) string {
+	return fmt.Sprintf("%s:%d", m.Address, registryPort)
+}
+
+// registryCert returns the certificate and the key of the registry, in PEM.
+// They're read from the files in the configuration or, when none is given,
+// from a self-signed certificate generated for the machine and kept in the
+// state directory, so a resumed install uses the same one.
+func registryCert(conf *Config, m *iaas.Machine) (string, string, error) {
+	if conf.Registry.cert != "" {
+		return conf.Registry.cert, conf.Registry.key, nil
+	}
+	certPath, keyPath := conf.Registry.Cert, conf.Registry.Key
+	if certPath == "" {
+		certPath = filepath.Join(stateDir(conf.Name), "registry.crt")
+		keyPath = filepath.Join(stateDir(conf.Name), "registry.key")
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			err = generateCert(m.Address, certPath, keyPath)
+			if err != nil {
+				return "", "", fmt.Errorf("unable to generate registry certificate: %s", err)
+			}
+		}
+	}
+	cert, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", "", err
+	}
+	return string(cert), string(key), nil
+}
+
+// generateCert writes a self-signed certificate for the given host, valid
+// for ten years, and its key.
+func generateCert(host, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host, Organization: []string{"yati"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(certPath), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// certsContainer creates a busybox container running the command, with the
+// certs.d directory of the Docker in the machine mounted in /certs.d.
+func certsContainer(client *docker.Client, cmd ...string) (string, error) {
+	return helperContainer(client, []string{dockerCertsDir + ":/certs.d"}, cmd...)
+}
+
+// installCACert copies the certificate of the registry to the certs.d
+// directory of the Docker in the machine, using a container that's never
+// started.
+func installCACert(client *docker.Client, addr, cert string) error {
+	id, err := certsContainer(client, "true")
+	if err != nil {
+		return err
+	}
+	defer removeContainer(client, id)
+	return uploadFiles(client, id, map[string]string{
+		fmt.Sprintf("/certs.d/%s/ca.crt", addr): cert,
+	})
+}
+
+// removeCACert removes the certificate of the registry from the certs.d
+// directory of the Docker in the machine.
+func removeCACert(client *docker.Client, addr string) error {
+	return runHelper(client, []string{dockerCertsDir + ":/certs.d"}, []string{"rm", "-rf", "/certs.d/" + addr})
+}
+
+// untrustRegistry removes the certificate of the registry from every
+// machine, returning the first failure.
+func untrustRegistry(machines []*iaas.Machine, addr string) error {
+	var first error
+	for _, m := range machines {
+		client, err := dockerClient(m)
+		if err == nil {
+			err = removeCACert(client, addr)
+		}
+		if err != nil && first == nil {
+			first = fmt.Errorf("machine %q: %s", m.Id, err)
+		}
+	}
+	return first
+}
+
+// trustRegistry makes the Docker of every machine trust the certificate of
+// the registry. Machines of some iaas, like ssh, outlive the installation, so
+// the certificate is removed on rollback, and from the machines already
+// trusting it when another one fails.
+var trustRegistry = action.Action{
+	Name: "trust-registry",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		addr := registryAddr(args.machine())
+		fmt.Fprintf(args.out, "Trusting registry %s...\n", addr)
+		cert, _, err := registryCert(args.config, args.machine())
+		if err != nil {
+			return nil, err
+		}
+		for i, m := range args.state.Machines {
+			client, err := dockerClient(m)
+			if err == nil {
+				err = installCACert(client, addr, cert)
+			}
+			if err != nil {
+				untrustRegistry(args.state.Machines[:i], addr)
+				return nil, fmt.Errorf("unable to trust registry in machine %q: %s", m.Id, err)
+			}
+		}
+		return nil, nil
+	},
+	Backward: func(ctx action.BWContext) {
+		args := ctx.Params[0].(*installArgs)
+		args.undo("trust-registry", untrustRegistry(args.state.Machines, registryAddr(args.machine())))
+	},
+	MinParams: 1,
+}
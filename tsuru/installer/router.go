@@ -0,0 +1,365 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/mailgun/vulcand/api"
+	"github.com/mailgun/vulcand/engine"
+	"github.com/mailgun/vulcand/plugin/registry"
+	"github.com/tsuru/tsuru/action"
+	galeb "github.com/tsuru/tsuru/router/galeb/client"
+)
+
+const (
+	etcdPort          = 2379
+	vulcandPort       = 8181
+	vulcandAPIPort    = 8182
+	galebPort         = 8080
+	galebAPIPort      = 8090
+	galebUser         = "admin"
+	galebConfigPath   = "/etc/galeb/manager.properties"
+	hipacheConfigPath = "/usr/local/lib/node_modules/hipache/config/config.json"
+
+	// checkApp is the app whose route is added to check the router.
+	checkApp = "yati-check"
+)
+
+// routeCheckTimeout is the time to wait for the test route to reach the
+// tsuru API.
+var routeCheckTimeout = 60 * time.Second
+
+// router is a router supported by tsuru. It knows the components it needs,
+// its section in tsuru.conf and how to add the route of an app, which is
+// used to check it after the install.
+type router struct {
+	components  func(conf *Config) []*Component
+	config      func(conf *Config, m *iaas.Machine) map[string]interface{}
+	addRoute    func(conf *Config, m *iaas.Machine, host, backend string) error
+	removeRoute func(conf *Config, m *iaas.Machine, host string) error
+}
+
+var routerTypes = []string{"hipache", "vulcand", "galeb"}
+
+var routers = map[string]*router{
+	"hipache": {
+		components: func(conf *Config) []*Component {
+			return []*Component{{
+				Name:  "hipache",
+				Image: "hipache:0.3.1",
+				Ports: []string{fmt.Sprint(routerPort)},
+				Files: func(m *iaas.Machine) (map[string]string, error) {
+					return hipacheFiles(conf, m)
+				},
+			}}
+		},
+		config: func(conf *Config, m *iaas.Machine) map[string]interface{} {
+			return map[string]interface{}{
+				"type":           "hipache",
+				"domain":         domain(conf, m),
+				"redis-server":   redisAddr(m),
+				"redis-password": conf.Redis.Password,
+			}
+		},
+		addRoute: func(conf *Config, m *iaas.Machine, host, backend string) error {
+			return hipacheAddRoute(redisURL(conf, m), host, backend)
+		},
+		removeRoute: func(conf *Config, m *iaas.Machine, host string) error {
+			return hipacheRemoveRoute(redisURL(conf, m), host)
+		},
+	},
+	"vulcand": {
+		components: func(conf *Config) []*Component {
+			return []*Component{
+				{
+					Name:  "etcd",
+					Image: "quay.io/coreos/etcd:v2.3.7",
+					Cmd: []string{
+						"-name", "etcd", "-data-dir", "/data",
+						"-listen-client-urls", fmt.Sprintf("http://0.0.0.0:%d", etcdPort),
+						"-advertise-client-urls", fmt.Sprintf("http://etcd:%d", etcdPort),
+					},
+					Binds: []string{conf.dataDir("etcd") + ":/data"},
+				},
+				{
+					Name:  "vulcand",
+					Image: "mailgun/vulcand:v0.8.0-beta.3",
+					Ports: []string{fmt.Sprintf("%d:%d", routerPort, vulcandPort), fmt.Sprint(vulcandAPIPort)},
+					Cmd: []string{
+						"/go/bin/vulcand", "-interface=0.0.0.0", "-apiInterface=0.0.0.0",
+						fmt.Sprintf("-port=%d", vulcandPort), fmt.Sprintf("-apiPort=%d", vulcandAPIPort),
+						fmt.Sprintf("-etcd=http://etcd:%d", etcdPort),
+					},
+					Links: []string{"etcd:etcd"},
+				},
+			}
+		},
+		config: func(conf *Config, m *iaas.Machine) map[string]interface{} {
+			return map[string]interface{}{
+				"type":    "vulcand",
+				"domain":  domain(conf, m),
+				"api-url": vulcandAPIURL(m),
+			}
+		},
+		addRoute: func(conf *Config, m *iaas.Machine, host, backend string) error {
+			return vulcandAddRoute(vulcandAPIURL(m), host, backend)
+		},
+		removeRoute: func(conf *Config, m *iaas.Machine, host string) error {
+			return vulcandRemoveRoute(vulcandAPIURL(m), host)
+		},
+	},
+	"galeb": {
+		components: func(conf *Config) []*Component {
+			return []*Component{{
+				Name:  "galeb",
+				Image: "galeb/galeb:3.2",
+				Ports: []string{fmt.Sprintf("%d:%d", routerPort, galebPort), fmt.Sprint(galebAPIPort)},
+				Files: func(m *iaas.Machine) (map[string]string, error) {
+					return map[string]string{galebConfigPath: galebConfig(conf)}, nil
+				},
+			}}
+		},
+		config: func(conf *Config, m *iaas.Machine) map[string]interface{} {
+			return map[string]interface{}{
+				"type":     "galeb",
+				"domain":   domain(conf, m),
+				"api-url":  galebAPIURL(m),
+				"username": galebUser,
+				"password": conf.Router.Password,
+			}
+		},
+		addRoute: func(conf *Config, m *iaas.Machine, host, backend string) error {
+			return galebAddRoute(galebClient(conf, m), host, backend)
+		},
+		removeRoute: func(conf *Config, m *iaas.Machine, host string) error {
+			return galebRemoveRoute(galebClient(conf, m), host)
+		},
+	},
+}
+
+// domain returns the wildcard domain of the apps. It defaults to the
+// nip.io domain of the machine, which resolves every subdomain to it.
+func domain(c *Config, m *iaas.Machine) string {
+	if c.Domain != "" {
+		return c.Domain
+	}
+	return fmt.Sprintf("%s.nip.io", m.Address)
+}
+
+func hipacheFiles(c *Config, m *iaas.Machine) (map[string]string, error) {
+	conf := fmt.Sprintf(`{
+  "server": {"accessLog": "/var/log/hipache/access.log", "workers": 5, "maxSockets": 100, "deadBackendTTL": 30},
+  "http": {"port": %d, "bind": ["0.0.0.0"]},
+  "driver": %q
+}
+`, routerPort, redisURL(c, m))
+	return map[string]string{hipacheConfigPath: conf}, nil
+}
+
+// hipacheAddRoute adds the frontend of the host to Redis, in the format
+// read by hipache.
+func hipacheAddRoute(redisURL, host, backend string) error {
+	conn, err := dialRedis(redisURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	key := "frontend:" + host
+	_, err = conn.Do("DEL", key)
+	if err == nil {
+		_, err = conn.Do("RPUSH", key, checkApp, backend)
+	}
+	return err
+}
+
+func hipacheRemoveRoute(redisURL, host string) error {
+	conn, err := dialRedis(redisURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", "frontend:"+host)
+	return err
+}
+
+func vulcandAPIURL(m *iaas.Machine) string {
+	return fmt.Sprintf("http://%s:%d", m.Address, vulcandAPIPort)
+}
+
+// vulcandAddRoute creates a backend with a single server and a frontend
+// matching the host, all named after the host.
+func vulcandAddRoute(apiURL, host, backend string) error {
+	client := api.NewClient(apiURL, registry.GetRegistry())
+	b, err := engine.NewHTTPBackend(host, engine.HTTPBackendSettings{})
+	if err != nil {
+		return err
+	}
+	err = client.UpsertBackend(*b)
+	if err != nil {
+		return err
+	}
+	server, err := engine.NewServer(host, backend)
+	if err != nil {
+		return err
+	}
+	err = client.UpsertServer(engine.BackendKey{Id: host}, *server, engine.NoTTL)
+	if err != nil {
+		return err
+	}
+	frontend, err := engine.NewHTTPFrontend(host, host, fmt.Sprintf("Host(%q)", host), engine.HTTPFrontendSettings{})
+	if err != nil {
+		return err
+	}
+	return client.UpsertFrontend(*frontend, engine.NoTTL)
+}
+
+func vulcandRemoveRoute(apiURL, host string) error {
+	client := api.NewClient(apiURL, registry.GetRegistry())
+	err := client.DeleteFrontend(engine.FrontendKey{Id: host})
+	if err != nil {
+		return err
+	}
+	return client.DeleteBackend(engine.BackendKey{Id: host})
+}
+
+func galebAPIURL(m *iaas.Machine) string {
+	return fmt.Sprintf("http://%s:%d/api", m.Address, galebAPIPort)
+}
+
+// galebConfig returns the configuration of the galeb manager, with the
+// credentials used by tsuru.
+func galebConfig(c *Config) string {
+	return fmt.Sprintf("manager.username=%s\nmanager.password=%s\nrouter.port=%d\n", galebUser, c.Router.Password, galebPort)
+}
+
+func galebClient(c *Config, m *iaas.Machine) *galeb.GalebClient {
+	return &galeb.GalebClient{
+		ApiUrl:   galebAPIURL(m),
+		Username: galebUser,
+		Password: c.Router.Password,
+	}
+}
+
+// galebAddRoute creates a pool with the backend, a virtual host for the
+// host and the rule linking them, all named after the host.
+func galebAddRoute(client *galeb.GalebClient, host, backend string) error {
+	backendURL, err := url.Parse(backend)
+	if err != nil {
+		return err
+	}
+	poolID, err := client.AddBackendPool(host)
+	if err != nil {
+		return err
+	}
+	virtualHostID, err := client.AddVirtualHost(host)
+	if err != nil {
+		return err
+	}
+	ruleID, err := client.AddRuleToID(host, poolID)
+	if err != nil {
+		return err
+	}
+	err = client.SetRuleVirtualHostIDs(ruleID, virtualHostID)
+	if err != nil {
+		return err
+	}
+	_, err = client.AddBackend(backendURL, host)
+	return err
+}
+
+func galebRemoveRoute(client *galeb.GalebClient, host string) error {
+	err := client.RemoveRuleVirtualHost(host, host)
+	if err != nil {
+		return err
+	}
+	err = client.RemoveRule(host)
+	if err != nil {
+		return err
+	}
+	err = client.RemoveVirtualHost(host)
+	if err != nil {
+		return err
+	}
+	targets, err := client.FindTargetsByParent(host)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		err = client.RemoveBackendByID(t.FullId())
+		if err != nil {
+			return err
+		}
+	}
+	return client.RemoveBackendPool(host)
+}
+
+// probeRoute requests the healthcheck of the tsuru API through the router
+// at addr, using the given host, until it answers or routeCheckTimeout
+// expires.
+func probeRoute(addr, host string) error {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/healthcheck/", addr), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = host
+	client := &http.Client{Timeout: 10 * time.Second}
+	deadline := time.Now().Add(routeCheckTimeout)
+	for {
+		err = doProbe(client, req)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func doProbe(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "WORKING" {
+		return fmt.Errorf("unexpected response from %s: %d %s", req.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// checkRoute adds the route of a test app pointing to the tsuru API and
+// checks that the router reaches it, removing the route afterwards.
+func checkRoute(conf *Config, m *iaas.Machine) error {
+	r := routers[conf.Router.Type]
+	host := checkApp + "." + domain(conf, m)
+	err := r.addRoute(conf, m, host, apiURL(m))
+	if err != nil {
+		return err
+	}
+	defer r.removeRoute(conf, m, host)
+	return probeRoute(fmt.Sprintf("%s:%d", m.Address, routerPort), host)
+}
+
+// checkRouter checks the router with the route of a test app. The route is
+// always removed, so there's nothing to undo.
+var checkRouter = action.Action{
+	Name: "check-router",
+	Forward: func(ctx action.FWContext) (action.Result, error) {
+		args := ctx.Params[0].(*installArgs)
+		fmt.Fprintf(args.out, "Checking %s router...\n", args.config.Router.Type)
+		err := args.hooks.CheckRoute(args.config, args.machine())
+		if err != nil {
+			return nil, fmt.Errorf("unable to check the router: %s", err)
+		}
+		return nil, nil
+	},
+	MinParams: 1,
+}
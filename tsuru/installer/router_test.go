@@ -0,0 +1,197 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func componentNames(conf *Config) []string {
+	var names []string
+	for _, comp := range components(conf) {
+		names = append(names, comp.Name)
+	}
+	return names
+}
+
+func (s *S) TestComponentsRouter(c *check.C) {
+	conf := DefaultConfig()
+	c.Assert(componentNames(conf), check.DeepEquals, []string{"mongodb", "redis", "hipache", "registry", "archive-server", "gandalf", "tsuru-api"})
+	conf.Router.Type = "vulcand"
+	c.Assert(componentNames(conf), check.DeepEquals, []string{"mongodb", "redis", "etcd", "vulcand", "registry", "archive-server", "gandalf", "tsuru-api"})
+	conf.Router.Type = "galeb"
+	c.Assert(componentNames(conf), check.DeepEquals, []string{"mongodb", "redis", "galeb", "registry", "archive-server", "gandalf", "tsuru-api"})
+}
+
+func (s *S) TestVulcandComponents(c *check.C) {
+	conf := DefaultConfig()
+	comps := routers["vulcand"].components(conf)
+	c.Assert(comps[0].Ports, check.HasLen, 0)
+	c.Assert(comps[0].Binds, check.DeepEquals, []string{"/var/lib/yati/tsuru/etcd:/data"})
+	c.Assert(comps[1].Ports, check.DeepEquals, []string{"80:8181", "8182"})
+	c.Assert(comps[1].Links, check.DeepEquals, []string{"etcd:etcd"})
+}
+
+func (s *S) TestGalebComponents(c *check.C) {
+	conf := DefaultConfig()
+	conf.Router.Password = "secret"
+	comps := routers["galeb"].components(conf)
+	c.Assert(comps, check.HasLen, 1)
+	files, err := comps[0].Files(&iaas.Machine{Address: "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(files, check.DeepEquals, map[string]string{
+		"/etc/galeb/manager.properties": "manager.username=admin\nmanager.password=secret\nrouter.port=8080\n",
+	})
+}
+
+func (s *S) TestRouterConfig(c *check.C) {
+	conf := DefaultConfig()
+	conf.Redis.Password = "redis-secret"
+	conf.Router.Password = "galeb-secret"
+	m := &iaas.Machine{Address: "10.0.0.1"}
+	c.Assert(routers["hipache"].config(conf, m), check.DeepEquals, map[string]interface{}{
+		"type":           "hipache",
+		"domain":         "10.0.0.1.nip.io",
+		"redis-server":   "10.0.0.1:6379",
+		"redis-password": "redis-secret",
+	})
+	conf.Domain = "tsuru.example.com"
+	c.Assert(routers["vulcand"].config(conf, m), check.DeepEquals, map[string]interface{}{
+		"type":    "vulcand",
+		"domain":  "tsuru.example.com",
+		"api-url": "http://10.0.0.1:8182",
+	})
+	c.Assert(routers["galeb"].config(conf, m), check.DeepEquals, map[string]interface{}{
+		"type":     "galeb",
+		"domain":   "tsuru.example.com",
+		"api-url":  "http://10.0.0.1:8090/api",
+		"username": "admin",
+		"password": "galeb-secret",
+	})
+}
+
+func (s *S) TestTsuruConfigRouter(c *check.C) {
+	conf := DefaultConfig()
+	conf.Router.Type = "vulcand"
+	out, err := tsuruConfig(conf, &iaas.Machine{Address: "10.0.0.1"})
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Matches, `(?s).*  router: vulcand\n.*`)
+	c.Assert(out, check.Matches, `(?s).*routers:\n  vulcand:\n    api-url: http://10.0.0.1:8182\n    domain: 10.0.0.1.nip.io\n    type: vulcand\n.*`)
+}
+
+func (s *S) TestHipacheRoute(c *check.C) {
+	addr, commands := fakeRedis(c, "secret")
+	err := hipacheAddRoute("redis://:secret@"+addr, "app.example.com", "http://10.0.0.1:8080")
+	c.Assert(err, check.IsNil)
+	c.Assert(<-commands, check.Equals, "AUTH secret")
+	c.Assert(<-commands, check.Equals, "DEL frontend:app.example.com")
+	c.Assert(<-commands, check.Equals, "RPUSH frontend:app.example.com yati-check http://10.0.0.1:8080")
+	addr, commands = fakeRedis(c, "secret")
+	err = hipacheRemoveRoute("redis://:secret@"+addr, "app.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(<-commands, check.Equals, "AUTH secret")
+	c.Assert(<-commands, check.Equals, "DEL frontend:app.example.com")
+}
+
+func (s *S) TestVulcandRoute(c *check.C) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	err := vulcandAddRoute(server.URL, "app.example.com", "http://10.0.0.1:8080")
+	c.Assert(err, check.IsNil)
+	err = vulcandRemoveRoute(server.URL, "app.example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(requests, check.DeepEquals, []string{
+		"POST /v2/backends",
+		"POST /v2/backends/app.example.com/servers",
+		"POST /v2/frontends",
+		"DELETE /v2/frontends/app.example.com",
+		"DELETE /v2/backends/app.example.com",
+	})
+}
+
+func (s *S) TestProbeRoute(c *check.C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "yati-check.example.com" || r.URL.Path != "/healthcheck/" {
+			http.Error(w, "no such route", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("WORKING"))
+	}))
+	defer server.Close()
+	timeout := routeCheckTimeout
+	routeCheckTimeout = 0
+	defer func() { routeCheckTimeout = timeout }()
+	addr := strings.TrimPrefix(server.URL, "http://")
+	err := probeRoute(addr, "yati-check.example.com")
+	c.Assert(err, check.IsNil)
+	err = probeRoute(addr, "other.example.com")
+	c.Assert(err, check.ErrorMatches, "unexpected response from other.example.com: 404 no such route")
+}
+
+func (s *S) TestInstallChecksRouter(c *check.C) {
+	i := s.installer(testConfig())
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(s.routeChecks, check.DeepEquals, []string{"hipache"})
+}
+
+func (s *S) TestInstallVulcand(c *check.C) {
+	conf := testConfig()
+	conf.Router.Type = "vulcand"
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	vulcand, err := client.InspectContainer("vulcand")
+	c.Assert(err, check.IsNil)
+	c.Assert(vulcand.HostConfig.Links, check.DeepEquals, []string{"etcd:etcd"})
+	c.Assert(s.routeChecks, check.DeepEquals, []string{"vulcand"})
+	var found bool
+	for _, archive := range s.uploads() {
+		found = found || strings.Contains(string(archive), fmt.Sprintf("api-url: http://%s:8182\n", testProvider.address))
+	}
+	c.Assert(found, check.Equals, true)
+}
+
+func (s *S) TestInstallGalebGeneratesPassword(c *check.C) {
+	conf := testConfig()
+	conf.Router.Type = "galeb"
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	state, err := LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	password, err := state.secret("router-password")
+	c.Assert(err, check.IsNil)
+	var found bool
+	for _, archive := range s.uploads() {
+		found = found || strings.Contains(string(archive), "manager.password="+password+"\n")
+	}
+	c.Assert(found, check.Equals, true)
+}
+
+func (s *S) TestInstallRouterCheckFailure(c *check.C) {
+	i := s.installer(testConfig())
+	i.CheckRoute = func(*Config, *iaas.Machine) error {
+		return errors.New("connection refused")
+	}
+	_, err := i.Install()
+	c.Assert(err, check.ErrorMatches, "unable to check the router: connection refused")
+	undone := err.(*InstallError).Undone
+	c.Assert(undone[0], check.Equals, "start-tsuru-api")
+}
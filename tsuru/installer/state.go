@@ -0,0 +1,133 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// State records what an installation created, so it can be resumed or
+// destroyed later. It's stored in ~/.yati/<name>/state.json and saved after
+// every step.
+type State struct {
+	Name       string
+	Iaas       string
+	APIURL     string
+	Machines   []*iaas.Machine
+	Containers []ContainerState
+	// DataDirs are the directories of the first machine where the
+	// components keep their data.
+	DataDirs []string
+	Steps    []string
+	Secrets  map[string]string
+}
+
+// ContainerState is a component container running in the first machine.
+type ContainerState struct {
+	Component string
+	ID        string
+}
+
+func stateDir(name string) string {
+	return cmd.JoinWithUserDir(".yati", name)
+}
+
+func statePath(name string) string {
+	return filepath.Join(stateDir(name), "state.json")
+}
+
+// LoadState reads the state of the named installation.
+func LoadState(name string) (*State, error) {
+	data, err := ioutil.ReadFile(statePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("installation %q not found", name)
+		}
+		return nil, err
+	}
+	var s State
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %s", statePath(name), err)
+	}
+	return &s, nil
+}
+
+func (s *State) Save() error {
+	err := os.MkdirAll(stateDir(s.Name), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath(s.Name), data, 0600)
+}
+
+// Remove deletes the state directory of the installation.
+func (s *State) Remove() error {
+	return os.RemoveAll(stateDir(s.Name))
+}
+
+// finished returns whether the given step was completed.
+func (s *State) finished(step string) bool {
+	for _, name := range s.Steps {
+		if name == step {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *State) removeStep(step string) {
+	for i, name := range s.Steps {
+		if name == step {
+			s.Steps = append(s.Steps[:i], s.Steps[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *State) removeContainer(id string) {
+	for i, c := range s.Containers {
+		if c.ID == id {
+			s.Containers = append(s.Containers[:i], s.Containers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *State) removeMachine(m *iaas.Machine) {
+	for i := range s.Machines {
+		if s.Machines[i].Id == m.Id {
+			s.Machines = append(s.Machines[:i], s.Machines[i+1:]...)
+			return
+		}
+	}
+}
+
+// secret returns the named secret, generating it on the first call.
+func (s *State) secret(name string) (string, error) {
+	if value, ok := s.Secrets[name]; ok {
+		return value, nil
+	}
+	value, err := generatePassword()
+	if err != nil {
+		return "", err
+	}
+	if s.Secrets == nil {
+		s.Secrets = make(map[string]string)
+	}
+	s.Secrets[name] = value
+	return value, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestStateSaveAndLoad(c *check.C) {
+	state := &State{
+		Name:       "staging",
+		Iaas:       "test-iaas",
+		APIURL:     "http://10.0.0.1:8080",
+		Machines:   []*iaas.Machine{{Id: "m1", Iaas: "test-iaas", Address: "10.0.0.1", Port: 2376}},
+		Containers: []ContainerState{{Component: "mongodb", ID: "abc"}},
+	}
+	err := state.Save()
+	c.Assert(err, check.IsNil)
+	info, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "staging", "state.json"))
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+	loaded, err := LoadState("staging")
+	c.Assert(err, check.IsNil)
+	c.Assert(loaded, check.DeepEquals, state)
+}
+
+func (s *S) TestLoadStateNotFound(c *check.C) {
+	_, err := LoadState("staging")
+	c.Assert(err, check.ErrorMatches, `installation "staging" not found`)
+}
+
+func (s *S) TestLoadStateInvalid(c *check.C) {
+	dir := filepath.Join(os.Getenv("HOME"), ".yati", "staging")
+	c.Assert(os.MkdirAll(dir, 0700), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "state.json"), []byte("{"), 0600), check.IsNil)
+	_, err := LoadState("staging")
+	c.Assert(err, check.ErrorMatches, `invalid state file .*state.json: .*`)
+}
+
+func (s *S) TestStateRemove(c *check.C) {
+	state := &State{Name: "staging"}
+	c.Assert(state.Save(), check.IsNil)
+	c.Assert(state.Remove(), check.IsNil)
+	_, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "staging"))
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
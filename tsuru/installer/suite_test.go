@@ -0,0 +1,274 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/iaas/fake"
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type S struct {
+	server *dtesting.DockerServer
+	home   string
+	// mu guards uploaded and execs, written by the handlers of the fake
+	// Docker server.
+	mu           sync.Mutex
+	uploaded     map[string][]byte
+	execs        []string
+	pings        []string
+	redisPings   []string
+	routeChecks  []string
+	sshKeys      []string
+	nodes        []string
+	removedNodes []string
+}
+
+var _ = check.Suite(&S{})
+
+var testProvider = &testIaas{}
+
+func init() {
+	iaas.MustRegister("test-iaas", testProvider)
+	iaas.MustRegister("schema-iaas", &schemaIaas{testProvider})
+	iaas.MustRegister("no-docker-iaas", &noDockerIaas{testProvider})
+}
+
+type testIaas struct {
+	address string
+	port    int
+	created []*iaas.Machine
+	deleted []*iaas.Machine
+}
+
+func (i *testIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	m := &iaas.Machine{
+		Id:             fmt.Sprintf("test-machine-%d", len(i.created)+1),
+		Iaas:           "test-iaas",
+		Address:        i.address,
+		Port:           i.port,
+		CreationParams: params,
+	}
+	i.created = append(i.created, m)
+	return m, nil
+}
+
+// schemaIaas is a testIaas that declares its params.
+type schemaIaas struct {
+	*testIaas
+}
+
+func (i *schemaIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "image", Required: true},
+		{Name: "size", Value: "small", Values: []string{"small", "large"}},
+	}
+}
+
+// noDockerIaas is a testIaas whose machines don't run Docker.
+type noDockerIaas struct {
+	*testIaas
+}
+
+func (i *noDockerIaas) CheckDocker(params map[string]string) error {
+	return errors.New("its machines don't run Docker")
+}
+
+func (i *testIaas) DeleteMachine(m *iaas.Machine) error {
+	i.deleted = append(i.deleted, m)
+	return nil
+}
+
+func (i *testIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	return i.created, nil
+}
+
+// GetMachine finds every machine that wasn't deleted, including the ones
+// saved in the states of the tests.
+func (i *testIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	for _, deleted := range i.deleted {
+		if deleted.Id == m.Id {
+			return nil, iaas.ErrMachineNotFound
+		}
+	}
+	return m, nil
+}
+
+func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
+	var err error
+	s.server, err = dtesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	s.mu.Lock()
+	s.uploaded = make(map[string][]byte)
+	s.execs = nil
+	s.mu.Unlock()
+	s.server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.uploaded[r.URL.Path] = append(s.uploaded[r.URL.Path], body...)
+		s.mu.Unlock()
+	}))
+	s.server.CustomHandler("/exec/.*/start", s.execHandler(c))
+	u, err := url.Parse(s.server.URL())
+	c.Assert(err, check.IsNil)
+	host, port, err := net.SplitHostPort(u.Host)
+	c.Assert(err, check.IsNil)
+	testProvider.address = host
+	testProvider.port, _ = strconv.Atoi(port)
+	testProvider.created = nil
+	testProvider.deleted = nil
+	s.pings = nil
+	s.redisPings = nil
+	s.routeChecks = nil
+	s.sshKeys = nil
+	s.nodes = nil
+	s.removedNodes = nil
+	fake.Default.Reset()
+	fake.Default.Address = host
+	fake.Default.Port = testProvider.port
+}
+
+// installer returns an installer whose hooks record the calls in the suite.
+func (s *S) installer(conf *Config) *Installer {
+	return &Installer{
+		Config: conf,
+		Hooks: Hooks{
+			PingMongoDB: func(mongoURL string) error {
+				s.pings = append(s.pings, mongoURL)
+				return nil
+			},
+			PingRedis: func(redisURL string) error {
+				s.redisPings = append(s.redisPings, redisURL)
+				return nil
+			},
+			CheckRoute: func(conf *Config, m *iaas.Machine) error {
+				s.routeChecks = append(s.routeChecks, conf.Router.Type)
+				return nil
+			},
+			AddSSHKey: func(gandalfURL, user, key string) error {
+				s.sshKeys = append(s.sshKeys, user+" "+key)
+				return nil
+			},
+			AddNodes: func(apiURL string, admin AdminConfig, addresses []string) error {
+				s.nodes = append(s.nodes, addresses...)
+				return nil
+			},
+			RemoveNodes: func(apiURL string, admin AdminConfig, addresses []string) error {
+				s.removedNodes = append(s.removedNodes, addresses...)
+				return nil
+			},
+		},
+	}
+}
+
+// execHandler fakes the hijacked connection of an exec start, recording
+// the input sent to the command.
+func (s *S) execHandler(c *check.C) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, check.IsNil)
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		rw.Flush()
+		input, _ := ioutil.ReadAll(rw)
+		s.mu.Lock()
+		s.execs = append(s.execs, string(input))
+		s.mu.Unlock()
+	})
+}
+
+// recordRemoved makes the fake Docker server record the paths removed by the
+// helper containers, like the ones of removeCACert and removeDataDirs,
+// returned by the function. The paths are the ones of the machine, found
+// through the binds of the container.
+func (s *S) recordRemoved() func() []string {
+	var mu sync.Mutex
+	var removed []string
+	client, _ := docker.NewClient(s.server.URL())
+	s.server.CustomHandler("/containers/.*/exec$", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var opts docker.CreateExecOptions
+		json.Unmarshal(body, &opts)
+		if len(opts.Cmd) > 2 && opts.Cmd[0] == "rm" {
+			container, _ := client.InspectContainer(strings.Split(r.URL.Path, "/")[2])
+			mu.Lock()
+			for _, p := range opts.Cmd[2:] {
+				for _, bind := range container.HostConfig.Binds {
+					parts := strings.SplitN(bind, ":", 2)
+					if strings.HasPrefix(p, parts[1]+"/") {
+						p = parts[0] + strings.TrimPrefix(p, parts[1])
+					}
+				}
+				removed = append(removed, p)
+			}
+			mu.Unlock()
+		}
+		s.server.DefaultHandler().ServeHTTP(w, r)
+	}))
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return removed
+	}
+}
+
+// uploads returns a copy of the archives uploaded to the containers, keyed
+// by the path of the request.
+func (s *S) uploads() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string][]byte, len(s.uploaded))
+	for k, v := range s.uploaded {
+		result[k] = v
+	}
+	return result
+}
+
+// execInputs returns the input sent to each exec, in order.
+func (s *S) execInputs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.execs...)
+}
+
+func (s *S) resetExecs() {
+	s.mu.Lock()
+	s.execs = nil
+	s.mu.Unlock()
+}
+
+func testConfig() *Config {
+	conf := DefaultConfig()
+	conf.Iaas.Name = "test-iaas"
+	conf.Admin.Password = "secret"
+	return conf
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.Stop()
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/tsuru/tsuru/cmd"
+)
+
+// Template is a named set of iaas params, so machines with the same shape
+// can be created again. Templates are stored in ~/.yati/templates.json.
+type Template struct {
+	Name   string
+	Iaas   string
+	Params map[string]string
+}
+
+func templatesPath() string {
+	return cmd.JoinWithUserDir(".yati", "templates.json")
+}
+
+// ListTemplates returns the templates sorted by name.
+func ListTemplates() ([]Template, error) {
+	data, err := ioutil.ReadFile(templatesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var templates []Template
+	err = json.Unmarshal(data, &templates)
+	if err != nil {
+		return nil, fmt.Errorf("invalid templates file %s: %s", templatesPath(), err)
+	}
+	sort.Sort(templatesByName(templates))
+	return templates, nil
+}
+
+func saveTemplates(templates []Template) error {
+	err := os.MkdirAll(filepath.Dir(templatesPath()), 0700)
+	if err != nil {
+		return err
+	}
+	sort.Sort(templatesByName(templates))
+	data, err := json.MarshalIndent(templates, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(templatesPath(), data, 0600)
+}
+
+// FindTemplate returns the template with the given name.
+func FindTemplate(name string) (*Template, error) {
+	templates, err := ListTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for i := range templates {
+		if templates[i].Name == name {
+			return &templates[i], nil
+		}
+	}
+	return nil, fmt.Errorf("template %q not found", name)
+}
+
+// AddTemplate saves a new template. The iaas must be registered and accept
+// the params, and the name must not be taken.
+func AddTemplate(t Template) error {
+	if !nameRegexp.MatchString(t.Name) {
+		return fmt.Errorf("invalid template name %q, it must contain only letters, numbers, dashes and underscores", t.Name)
+	}
+	_, err := iaas.ValidateParams(t.Iaas, t.Params)
+	if err != nil {
+		return err
+	}
+	templates, err := ListTemplates()
+	if err != nil {
+		return err
+	}
+	for _, existing := range templates {
+		if existing.Name == t.Name {
+			return fmt.Errorf("template %q already exists", t.Name)
+		}
+	}
+	return saveTemplates(append(templates, t))
+}
+
+// RemoveTemplate deletes the template with the given name.
+func RemoveTemplate(name string) error {
+	templates, err := ListTemplates()
+	if err != nil {
+		return err
+	}
+	for i, t := range templates {
+		if t.Name == name {
+			return saveTemplates(append(templates[:i], templates[i+1:]...))
+		}
+	}
+	return fmt.Errorf("template %q not found", name)
+}
+
+// ApplyTemplate makes the configuration use the iaas of the named template.
+// The params in the configuration override the ones in the template. It
+// fails when the configuration file sets another iaas.
+func ApplyTemplate(conf *Config, name string) error {
+	t, err := FindTemplate(name)
+	if err != nil {
+		return err
+	}
+	if conf.iaasSet && conf.Iaas.Name != t.Iaas {
+		return fmt.Errorf("template %q uses iaas %q, not %q", t.Name, t.Iaas, conf.Iaas.Name)
+	}
+	params := make(map[string]string, len(t.Params)+len(conf.Iaas.Params))
+	for k, v := range t.Params {
+		params[k] = v
+	}
+	for k, v := range conf.Iaas.Params {
+		params[k] = v
+	}
+	conf.Iaas = IaasConfig{Name: t.Iaas, Params: params}
+	return nil
+}
+
+type templatesByName []Template
+
+func (l templatesByName) Len() int           { return len(l) }
+func (l templatesByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l templatesByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
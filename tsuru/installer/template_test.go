@@ -0,0 +1,125 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestAddAndListTemplates(c *check.C) {
+	err := AddTemplate(Template{Name: "large", Iaas: "test-iaas", Params: map[string]string{"memory": "8192"}})
+	c.Assert(err, check.IsNil)
+	err = AddTemplate(Template{Name: "small", Iaas: "schema-iaas", Params: map[string]string{"image": "ubuntu", "size": "small"}})
+	c.Assert(err, check.IsNil)
+	err = AddTemplate(Template{Name: "medium", Iaas: "test-iaas"})
+	c.Assert(err, check.IsNil)
+	templates, err := ListTemplates()
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.DeepEquals, []Template{
+		{Name: "large", Iaas: "test-iaas", Params: map[string]string{"memory": "8192"}},
+		{Name: "medium", Iaas: "test-iaas"},
+		{Name: "small", Iaas: "schema-iaas", Params: map[string]string{"image": "ubuntu", "size": "small"}},
+	})
+	info, err := os.Stat(filepath.Join(os.Getenv("HOME"), ".yati", "templates.json"))
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Mode().Perm(), check.Equals, os.FileMode(0600))
+}
+
+func (s *S) TestListTemplatesEmpty(c *check.C) {
+	templates, err := ListTemplates()
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.HasLen, 0)
+}
+
+func (s *S) TestListTemplatesInvalidFile(c *check.C) {
+	dir := filepath.Join(os.Getenv("HOME"), ".yati")
+	c.Assert(os.MkdirAll(dir, 0700), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "templates.json"), []byte("{"), 0600), check.IsNil)
+	_, err := ListTemplates()
+	c.Assert(err, check.ErrorMatches, "invalid templates file .*templates.json: .*")
+}
+
+func (s *S) TestAddTemplateDuplicated(c *check.C) {
+	err := AddTemplate(Template{Name: "large", Iaas: "test-iaas"})
+	c.Assert(err, check.IsNil)
+	err = AddTemplate(Template{Name: "large", Iaas: "schema-iaas", Params: map[string]string{"image": "ubuntu"}})
+	c.Assert(err, check.ErrorMatches, `template "large" already exists`)
+}
+
+func (s *S) TestAddTemplateUnknownIaas(c *check.C) {
+	err := AddTemplate(Template{Name: "large", Iaas: "unknown"})
+	c.Assert(err, check.ErrorMatches, `iaas "unknown" is not registered, available: .*`)
+}
+
+func (s *S) TestAddTemplateInvalidParams(c *check.C) {
+	err := AddTemplate(Template{Name: "small", Iaas: "schema-iaas", Params: map[string]string{"size": "tiny"}})
+	c.Assert(err, check.ErrorMatches, `(?s)invalid params for iaas "schema-iaas":.*the parameter "image" is required.*`)
+	templates, err := ListTemplates()
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.HasLen, 0)
+}
+
+func (s *S) TestAddTemplateInvalidName(c *check.C) {
+	err := AddTemplate(Template{Name: "my template", Iaas: "test-iaas"})
+	c.Assert(err, check.ErrorMatches, `invalid template name "my template", .*`)
+}
+
+func (s *S) TestFindTemplate(c *check.C) {
+	err := AddTemplate(Template{Name: "large", Iaas: "test-iaas", Params: map[string]string{"memory": "8192"}})
+	c.Assert(err, check.IsNil)
+	t, err := FindTemplate("large")
+	c.Assert(err, check.IsNil)
+	c.Assert(t, check.DeepEquals, &Template{Name: "large", Iaas: "test-iaas", Params: map[string]string{"memory": "8192"}})
+	_, err = FindTemplate("small")
+	c.Assert(err, check.ErrorMatches, `template "small" not found`)
+}
+
+func (s *S) TestRemoveTemplate(c *check.C) {
+	c.Assert(AddTemplate(Template{Name: "large", Iaas: "test-iaas"}), check.IsNil)
+	c.Assert(AddTemplate(Template{Name: "small", Iaas: "test-iaas"}), check.IsNil)
+	err := RemoveTemplate("large")
+	c.Assert(err, check.IsNil)
+	templates, err := ListTemplates()
+	c.Assert(err, check.IsNil)
+	c.Assert(templates, check.DeepEquals, []Template{{Name: "small", Iaas: "test-iaas"}})
+	err = RemoveTemplate("large")
+	c.Assert(err, check.ErrorMatches, `template "large" not found`)
+}
+
+func (s *S) TestApplyTemplate(c *check.C) {
+	err := AddTemplate(Template{Name: "small", Iaas: "schema-iaas", Params: map[string]string{"image": "ubuntu", "size": "small"}})
+	c.Assert(err, check.IsNil)
+	conf := testConfig()
+	conf.Iaas.Params = map[string]string{"size": "large"}
+	err = ApplyTemplate(conf, "small")
+	c.Assert(err, check.IsNil)
+	c.Assert(conf.Iaas, check.DeepEquals, IaasConfig{Name: "schema-iaas", Params: map[string]string{"image": "ubuntu", "size": "large"}})
+	i := s.installer(conf)
+	_, err = i.Install()
+	c.Assert(err, check.IsNil)
+	c.Assert(testProvider.created[0].CreationParams, check.DeepEquals, map[string]string{"image": "ubuntu", "size": "large"})
+}
+
+func (s *S) TestApplyTemplateOfOtherIaas(c *check.C) {
+	err := AddTemplate(Template{Name: "large", Iaas: "test-iaas"})
+	c.Assert(err, check.IsNil)
+	conf, err := parseConfig("yati.yml", []byte("iaas:\n  name: schema-iaas\n"))
+	c.Assert(err, check.IsNil)
+	err = ApplyTemplate(conf, "large")
+	c.Assert(err, check.ErrorMatches, `template "large" uses iaas "test-iaas", not "schema-iaas"`)
+	conf, err = parseConfig("yati.yml", []byte("iaas:\n  name: test-iaas\n"))
+	c.Assert(err, check.IsNil)
+	c.Assert(ApplyTemplate(conf, "large"), check.IsNil)
+	c.Assert(ApplyTemplate(DefaultConfig(), "large"), check.IsNil)
+}
+
+func (s *S) TestApplyTemplateNotFound(c *check.C) {
+	err := ApplyTemplate(testConfig(), "small")
+	c.Assert(err, check.ErrorMatches, `template "small" not found`)
+}
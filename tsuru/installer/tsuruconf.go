@@ -0,0 +1,70 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"gopkg.in/yaml.v1"
+)
+
+// tsuruConfig returns the tsuru.conf used by the tsuru API running in the
+// given machine.
+func tsuruConfig(c *Config, m *iaas.Machine) (string, error) {
+	mongoURL := mongoURL(c, m)
+	dockerConf := map[string]interface{}{
+		"collection":           "docker",
+		"registry":             registryAddr(m),
+		"router":               c.Router.Type,
+		"repository-namespace": "tsuru",
+		"cluster": map[string]interface{}{
+			"storage":        "mongodb",
+			"mongo-url":      mongoURL,
+			"mongo-database": "cluster",
+		},
+	}
+	if c.Registry.Username != "" {
+		dockerConf["registry-auth"] = map[string]interface{}{
+			"username": c.Registry.Username,
+			"password": c.Registry.Password,
+		}
+	}
+	conf := map[string]interface{}{
+		"listen": fmt.Sprintf("0.0.0.0:%d", apiPort),
+		"host":   apiURL(m),
+		"database": map[string]interface{}{
+			"url":  mongoURL,
+			"name": tsuruDatabase,
+		},
+		"auth": map[string]interface{}{
+			"scheme":            "native",
+			"user-registration": true,
+		},
+		"provisioner": "docker",
+		"docker":      dockerConf,
+		"routers": map[string]interface{}{
+			c.Router.Type: routers[c.Router.Type].config(c, m),
+		},
+		"pubsub": map[string]interface{}{
+			"redis-host":     m.Address,
+			"redis-port":     redisPort,
+			"redis-password": c.Redis.Password,
+		},
+		"queue": map[string]interface{}{
+			"mongo-url":      mongoURL,
+			"mongo-database": "queuedb",
+		},
+		"repo-manager": "gandalf",
+		"git": map[string]interface{}{
+			"api-server": gandalfURL(m),
+		},
+	}
+	out, err := yaml.Marshal(conf)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Uninstall removes the containers and their data, the certificate of the
+// registry trusted by Docker and the machines created by the named
+// installation, and then
+// deletes its state. Machines that no longer exist in the iaas are skipped,
+// and the ones that could not be deleted are kept in the state, so Uninstall
+// can be called again.
+func Uninstall(name string, out io.Writer) error {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	state, err := LoadState(name)
+	if err != nil {
+		return err
+	}
+	provider, err := iaas.Get(state.Iaas)
+	if err != nil {
+		return err
+	}
+	if len(state.Machines) > 0 {
+		removeContainers(state, out)
+		err = untrustRegistry(state.Machines, registryAddr(state.Machines[0]))
+		if err != nil {
+			fmt.Fprintf(out, "Failed to untrust registry: %s\n", err)
+		}
+	}
+	var remaining []*iaas.Machine
+	for _, m := range state.Machines {
+		if _, err = provider.GetMachine(m); err == iaas.ErrMachineNotFound {
+			fmt.Fprintf(out, "Machine %s no longer exists.\n", m.Id)
+			continue
+		}
+		fmt.Fprintf(out, "Deleting machine %s...\n", m.Id)
+		err = provider.DeleteMachine(m)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to delete machine %s: %s\n", m.Id, err)
+			remaining = append(remaining, m)
+		}
+	}
+	if len(remaining) > 0 {
+		state.Machines = remaining
+		err = state.Save()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("unable to delete %d machine(s)", len(remaining))
+	}
+	return state.Remove()
+}
+
+// removeContainers removes the component containers in the reverse order
+// they were started, and then their data directories. Failures are only
+// reported, since deleting the machine also gets rid of its containers.
+func removeContainers(state *State, out io.Writer) {
+	client, err := dockerClient(state.Machines[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to connect to %s: %s\n", state.Machines[0].Address, err)
+		return
+	}
+	for i := len(state.Containers) - 1; i >= 0; i-- {
+		c := state.Containers[i]
+		fmt.Fprintf(out, "Removing %s...\n", c.Component)
+		err = removeContainer(client, c.ID)
+		if _, ok := err.(*docker.NoSuchContainer); err != nil && !ok {
+			fmt.Fprintf(out, "Failed to remove %s: %s\n", c.Component, err)
+		}
+	}
+	state.Containers = nil
+	if len(state.DataDirs) > 0 {
+		fmt.Fprintf(out, "Removing data directories...\n")
+		err = removeDataDirs(client, state.DataDirs)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to remove the data directories: %s\n", err)
+		}
+	}
+}
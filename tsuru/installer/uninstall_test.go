@@ -0,0 +1,120 @@
+// Copyright 2016 yati authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package installer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/check.v1"
+)
+
+func (s *S) TestUninstall(c *check.C) {
+	conf := testConfig()
+	conf.Machines = 2
+	i := s.installer(conf)
+	_, err := i.Install()
+	c.Assert(err, check.IsNil)
+	removed := s.recordRemoved()
+	var out bytes.Buffer
+	err = Uninstall("tsuru", &out)
+	c.Assert(err, check.IsNil)
+	path := fmt.Sprintf("/etc/docker/certs.d/%s:5000", testProvider.address)
+	c.Assert(removed(), check.DeepEquals, []string{"/var/lib/yati/tsuru", path, path})
+	client, err := docker.NewClient(s.server.URL())
+	c.Assert(err, check.IsNil)
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(containers, check.HasLen, 0)
+	c.Assert(testProvider.deleted, check.DeepEquals, testProvider.created)
+	_, err = LoadState("tsuru")
+	c.Assert(err, check.ErrorMatches, `installation "tsuru" not found`)
+	c.Assert(out.String(), check.Matches, `(?s)Removing tsuru-api.*Removing mongodb.*Removing data directories.*Deleting machine test-machine-1.*Deleting machine test-machine-2.*`)
+}
+
+func (s *S) TestUninstallNotFound(c *check.C) {
+	err := Uninstall("staging", nil)
+	c.Assert(err, check.ErrorMatches, `installation "staging" not found`)
+}
+
+func (s *S) TestUninstallMissingContainers(c *check.C) {
+	state := &State{
+		Name:       "tsuru",
+		Iaas:       "test-iaas",
+		Machines:   []*iaas.Machine{{Id: "m1", Address: testProvider.address, Port: testProvider.port}},
+		Containers: []ContainerState{{Component: "mongodb", ID: "gone"}},
+	}
+	c.Assert(state.Save(), check.IsNil)
+	var out bytes.Buffer
+	err := Uninstall("tsuru", &out)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Not(check.Matches), `(?s).*Failed.*`)
+	c.Assert(testProvider.deleted, check.HasLen, 1)
+}
+
+func (s *S) TestUninstallDataDirs(c *check.C) {
+	removed := s.recordRemoved()
+	state := &State{
+		Name:     "tsuru",
+		Iaas:     "test-iaas",
+		Machines: []*iaas.Machine{{Id: "m1", Address: testProvider.address, Port: testProvider.port}},
+		DataDirs: []string{"/var/lib/yati/tsuru", "/mnt/mongodb/", "/", "volume"},
+	}
+	c.Assert(state.Save(), check.IsNil)
+	err := Uninstall("tsuru", nil)
+	c.Assert(err, check.IsNil)
+	cert := fmt.Sprintf("/etc/docker/certs.d/%s:5000", testProvider.address)
+	c.Assert(removed(), check.DeepEquals, []string{"/var/lib/yati/tsuru", "/mnt/mongodb", cert})
+}
+
+func (s *S) TestUninstallSkipsMachinesGone(c *check.C) {
+	testProvider.deleted = []*iaas.Machine{{Id: "m2"}}
+	state := &State{
+		Name:     "tsuru",
+		Iaas:     "test-iaas",
+		Machines: []*iaas.Machine{{Id: "m1", Address: testProvider.address, Port: testProvider.port}, {Id: "m2"}},
+	}
+	c.Assert(state.Save(), check.IsNil)
+	var out bytes.Buffer
+	err := Uninstall("tsuru", &out)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.String(), check.Matches, `(?s).*Deleting machine m1\.\.\.\nMachine m2 no longer exists\.\n.*`)
+	c.Assert(testProvider.deleted, check.HasLen, 2)
+	c.Assert(testProvider.deleted[1].Id, check.Equals, "m1")
+	_, err = LoadState("tsuru")
+	c.Assert(err, check.ErrorMatches, `installation "tsuru" not found`)
+}
+
+type failingIaas struct {
+	testIaas
+}
+
+func (i *failingIaas) DeleteMachine(m *iaas.Machine) error {
+	if m.Id == "m2" {
+		return errors.New("machine is locked")
+	}
+	return i.testIaas.DeleteMachine(m)
+}
+
+func (s *S) TestUninstallKeepsMachinesNotDeleted(c *check.C) {
+	iaas.Register("failing-iaas", &failingIaas{})
+	state := &State{
+		Name:     "tsuru",
+		Iaas:     "failing-iaas",
+		Machines: []*iaas.Machine{{Id: "m1", Address: testProvider.address, Port: testProvider.port}, {Id: "m2"}},
+	}
+	c.Assert(state.Save(), check.IsNil)
+	var out bytes.Buffer
+	err := Uninstall("tsuru", &out)
+	c.Assert(err, check.ErrorMatches, `unable to delete 1 machine\(s\)`)
+	c.Assert(out.String(), check.Matches, `(?s).*Failed to delete machine m2: machine is locked.*`)
+	state, err = LoadState("tsuru")
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Machines, check.HasLen, 1)
+	c.Assert(state.Machines[0].Id, check.Equals, "m2")
+}
@@ -7,6 +7,12 @@ package main
 import (
 	"os"
 
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/cloudstack"
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/digitalocean"
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/dockermachine"
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/ec2"
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/local"
+	_ "github.com/andrewsmedina/yati/tsuru/iaas/ssh"
 	"github.com/tsuru/tsuru/cmd"
 )
 
@@ -14,6 +20,12 @@ const version = "0.1.0"
 
 func buildManager(name string) *cmd.Manager {
 	m := cmd.BuildBaseManager(name, version, "", nil)
+	m.Register(&install{})
+	m.Register(&uninstall{})
+	m.Register(&destroy{})
+	m.Register(&templateAdd{})
+	m.Register(&templateList{})
+	m.Register(&templateRemove{})
 	return m
 }
 
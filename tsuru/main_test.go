@@ -18,3 +18,33 @@ func (s *S) TestCommandsFromBaseManagerAreRegistered(c *check.C) {
 		c.Assert(command, check.FitsTypeOf, instance)
 	}
 }
+
+func (s *S) TestInstallIsRegistered(c *check.C) {
+	manager := buildManager("tsuru")
+	command, ok := manager.Commands["install"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &install{})
+}
+
+func (s *S) TestUninstallIsRegistered(c *check.C) {
+	manager := buildManager("tsuru")
+	command, ok := manager.Commands["uninstall"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &uninstall{})
+	command, ok = manager.Commands["destroy"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &destroy{})
+}
+
+func (s *S) TestTemplateCommandsAreRegistered(c *check.C) {
+	manager := buildManager("tsuru")
+	command, ok := manager.Commands["machine-template-add"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &templateAdd{})
+	command, ok = manager.Commands["machine-template-list"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &templateList{})
+	command, ok = manager.Commands["machine-template-remove"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(command, check.FitsTypeOf, &templateRemove{})
+}
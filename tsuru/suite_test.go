@@ -6,21 +6,108 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"testing"
 
+	"github.com/andrewsmedina/yati/tsuru/iaas"
+	"github.com/andrewsmedina/yati/tsuru/installer"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
 	"github.com/tsuru/tsuru/cmd"
 	"gopkg.in/check.v1"
 )
 
-type S struct{}
+type S struct {
+	server *dtesting.DockerServer
+	home   string
+}
 
 var _ = check.Suite(&S{})
 var manager *cmd.Manager
 
 func Test(t *testing.T) { check.TestingT(t) }
 
+var testProvider = &testIaas{}
+
+func init() {
+	iaas.MustRegister("test-iaas", testProvider)
+}
+
+type testIaas struct {
+	address string
+	port    int
+	params  map[string]string
+}
+
+func (i *testIaas) CreateMachine(params map[string]string) (*iaas.Machine, error) {
+	i.params = params
+	return &iaas.Machine{Id: "test-machine", Iaas: "test-iaas", Address: i.address, Port: i.port}, nil
+}
+
+func (i *testIaas) DeleteMachine(m *iaas.Machine) error {
+	return nil
+}
+
+func (i *testIaas) ListMachines(params map[string]string) ([]*iaas.Machine, error) {
+	return nil, nil
+}
+
+func (i *testIaas) GetMachine(m *iaas.Machine) (*iaas.Machine, error) {
+	return m, nil
+}
+
+func (i *testIaas) Describe() string {
+	return "Test IaaS params: memory, verbose and config.\n"
+}
+
+func (i *testIaas) Flags() []iaas.Flag {
+	return []iaas.Flag{
+		{Name: "memory", Usage: "Memory of the machine", Type: iaas.IntFlag, Value: "1024"},
+		{Name: "verbose", Usage: "Log everything", Type: iaas.BoolFlag},
+		{Name: "config", Usage: "Config of the machine"},
+	}
+}
+
 func (s *S) SetUpTest(c *check.C) {
+	s.home = os.Getenv("HOME")
+	os.Setenv("HOME", c.MkDir())
 	var stdout, stderr bytes.Buffer
 	manager = cmd.NewManager("yati", version, "", &stdout, &stderr, os.Stdin, nil)
+	var err error
+	s.server, err = dtesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	s.server.CustomHandler("/containers/.*/archive", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.server.CustomHandler("/exec/.*/start", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		c.Assert(err, check.IsNil)
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+		rw.Flush()
+		ioutil.ReadAll(rw)
+	}))
+	u, err := url.Parse(s.server.URL())
+	c.Assert(err, check.IsNil)
+	host, port, err := net.SplitHostPort(u.Host)
+	c.Assert(err, check.IsNil)
+	testProvider.address = host
+	testProvider.port, _ = strconv.Atoi(port)
+	testProvider.params = nil
+	installHooks = installer.Hooks{
+		PingMongoDB: func(string) error { return nil },
+		PingRedis:   func(string) error { return nil },
+		CheckRoute:  func(*installer.Config, *iaas.Machine) error { return nil },
+		AddSSHKey:   func(string, string, string) error { return nil },
+		AddNodes:    func(string, installer.AdminConfig, []string) error { return nil },
+		RemoveNodes: func(string, installer.AdminConfig, []string) error { return nil },
+	}
+}
+
+func (s *S) TearDownTest(c *check.C) {
+	os.Setenv("HOME", s.home)
+	s.server.Stop()
 }